@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v3"
+	"movephoto/logging"
+)
+
+// unixPrefix marks an apiAddress or metricsAddress that is a Unix socket path
+const unixPrefix = "unix:"
+
+// apiHandler returns the handler of the status and control API. With
+// withMetrics the Prometheus metrics are served on /metrics as well.
+func apiHandler(withMetrics bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", apiMethod(http.MethodGet, handleHealth))
+	mux.HandleFunc("/config", apiMethod(http.MethodGet, handleConfig))
+	mux.HandleFunc("/imports", apiMethod(http.MethodGet, handleImports))
+	mux.HandleFunc("/pending", apiMethod(http.MethodGet, handlePending))
+	mux.HandleFunc("/errors", apiMethod(http.MethodGet, handleErrors))
+	mux.HandleFunc("/scan", apiMethod(http.MethodPost, handleScan))
+	mux.HandleFunc("/pause", apiMethod(http.MethodPost, handlePause(true)))
+	mux.HandleFunc("/resume", apiMethod(http.MethodPost, handlePause(false)))
+	mux.HandleFunc("/retry", apiMethod(http.MethodPost, handleRetry))
+	if withMetrics {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	return mux
+}
+
+// apiMethod rejects requests to handler that don't use method
+func apiMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method %s not allowed, use %s", r.Method, method)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// writeJSON sends v as the JSON response body
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Debug("Failed to write API response", logging.Err(err))
+	}
+}
+
+// writeError sends an error response of the form {"error": "..."}
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeJSON(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	scanning, started, finished := status.snapshot()
+	health := map[string]interface{}{
+		"status":   "ok",
+		"scanning": scanning,
+		"paused":   status.pausedDirs(),
+		"summary":  summary.String(),
+	}
+	if !started.IsZero() {
+		health["lastScanStarted"] = started
+	}
+	if !finished.IsZero() {
+		health["lastScanFinished"] = finished
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+// redacted replaces secrets in the config served by the API
+const redacted = "REDACTED"
+
+// handleConfig returns the current config with the field names of the config
+// file, without the secrets of its hooks
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := yaml.Marshal(redactConfig(status.currentConfig()))
+	if err == nil {
+		var fields map[string]interface{}
+		if err = yaml.Unmarshal(data, &fields); err == nil {
+			writeJSON(w, http.StatusOK, fields)
+			return
+		}
+	}
+	writeError(w, http.StatusInternalServerError, "encoding config: %v", err)
+}
+
+// redactConfig returns config with the header values of its webhooks and the
+// credentials and query values of their URLs replaced, as those often carry
+// tokens
+func redactConfig(config Config) Config {
+	hooks := make([]Hook, len(config.Hooks))
+	for i, hook := range config.Hooks {
+		if len(hook.Headers) > 0 {
+			headers := make(map[string]string, len(hook.Headers))
+			for name := range hook.Headers {
+				headers[name] = redacted
+			}
+			hook.Headers = headers
+		}
+		if u, err := url.Parse(hook.URL); err != nil {
+			hook.URL = redacted
+		} else if u.User != nil || u.RawQuery != "" {
+			if u.User != nil {
+				u.User = url.User(redacted)
+			}
+			query := u.Query()
+			for name := range query {
+				query.Set(name, redacted)
+			}
+			u.RawQuery = query.Encode()
+			hook.URL = u.String()
+		}
+		hooks[i] = hook
+	}
+	config.Hooks = hooks
+	return config
+}
+
+// handleImports returns the most recent imports, ?limit=N of them (50 by default)
+func handleImports(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid limit %q", value)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, status.recentImports(limit))
+}
+
+func handlePending(w http.ResponseWriter, r *http.Request) {
+	queued, deferred := status.pendingFiles()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"queued": queued, "deferred": deferred})
+}
+
+func handleErrors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, failures.list())
+}
+
+func handleScan(w http.ResponseWriter, r *http.Request) {
+	status.requestScan()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "scan requested"})
+}
+
+// handlePause pauses or resumes the watch directory given as ?path=
+func handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if !isWatchDir(status.currentConfig(), path) {
+			writeError(w, http.StatusNotFound, "%q is not a watch directory", path)
+			return
+		}
+		status.setPaused(path, paused)
+		if paused {
+			slog.Info("Paused watch directory", "dir", path)
+		} else {
+			slog.Info("Resumed watch directory", "dir", path)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"paused": status.pausedDirs()})
+	}
+}
+
+// handleRetry forgets the failed attempts of the file given as ?path=, so the
+// next scan tries it again straight away, and starts that scan
+func handleRetry(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	record, found, moved := failures.retry(path)
+	switch {
+	case !found:
+		writeError(w, http.StatusNotFound, "no failed file %q", path)
+		return
+	case moved:
+		writeError(w, http.StatusConflict, "%q was moved to %q, move it back to retry it", path, record.MovedTo)
+		return
+	}
+	slog.Info("Retrying file", "source", path)
+	status.requestScan()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "retry requested"})
+}
+
+// isWatchDir reports whether path is one of the watch directories of config
+func isWatchDir(config Config, path string) bool {
+	for _, watchDir := range config.WatchDirs {
+		if watchDir.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// listen opens a listener on address, which is host:port or unix:/path/to/socket.
+// A socket file left behind by an earlier run is replaced.
+func listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+// serve serves handler on address until the process exits. name describes
+// the server in the log.
+func serve(name, address string, handler http.Handler) {
+	listener, err := listen(address)
+	if err != nil {
+		slog.Error("Failed to listen", "server", name, "address", address, logging.Err(err))
+		return
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		slog.Info("Serving "+name, "address", address)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Listener failed", "server", name, "address", address, logging.Err(err))
+		}
+	}()
+}
+
+// checkListenAddress returns an error if address can't be listened on
+func checkListenAddress(field, address string) error {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		if path == "" {
+			return fmt.Errorf("%s %q has no socket path", field, address)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("invalid %s %q, expected host:port or unix:/path/to/socket", field, address)
+	}
+	return nil
+}
+
+// isLoopback reports whether address can only be reached from this machine
+func isLoopback(address string) bool {
+	if strings.HasPrefix(address, unixPrefix) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
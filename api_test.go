@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A file moved to the needs attention folder isn't where the next scan looks,
+// so retrying it only works once it is moved back
+func TestRetryMovedFile(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "photo.jpg")
+	saved := failures
+	failures = &failureDB{records: map[string]failureRecord{
+		source: {Source: source, GaveUp: true, MovedTo: filepath.Join(dir, "attention", "photo.jpg")},
+	}}
+	defer func() { failures = saved }()
+
+	retry := func(path string) int {
+		recorder := httptest.NewRecorder()
+		handleRetry(recorder, httptest.NewRequest(http.MethodPost, "/retry?path="+url.QueryEscape(path), nil))
+		return recorder.Code
+	}
+	if code := retry(filepath.Join(dir, "other.jpg")); code != http.StatusNotFound {
+		t.Errorf("retry of an unknown file: %d, want %d", code, http.StatusNotFound)
+	}
+	if code := retry(source); code != http.StatusConflict {
+		t.Errorf("retry of a moved file: %d, want %d", code, http.StatusConflict)
+	}
+	if len(failures.list()) != 1 {
+		t.Fatal("retry forgot a file that was moved aside")
+	}
+
+	if err := os.WriteFile(source, []byte("back"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := retry(source); code != http.StatusAccepted {
+		t.Errorf("retry of a file moved back: %d, want %d", code, http.StatusAccepted)
+	}
+	if len(failures.list()) != 0 {
+		t.Error("retry kept the failures of a file moved back")
+	}
+}
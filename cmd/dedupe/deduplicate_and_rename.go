@@ -0,0 +1,503 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"movephoto/dates"
+	"movephoto/filter"
+	"movephoto/logging"
+	"movephoto/metadata"
+	"movephoto/report"
+)
+
+var (
+	targetDir   = flag.String("dir", "", "Path to the destination directory where duplicates need to be removed")
+	dryRun      = flag.Bool("dry-run", false, "Perform a dry run without deleting or renaming any files")
+	verbose     = flag.Bool("verbose", false, "Enable verbose output (same as -log-level debug)")
+	minFileSize = flag.Int64("min-size", 1024, "Minimum file size (in bytes) to process")
+	maxFileSize = flag.Int64("max-size", 0, "Maximum file size (in bytes) to process, 0 means no limit")
+	trashDir    = flag.String("trash-dir", "", "Directory to move duplicates instead of deleting")
+	reportDir   = flag.String("report-dir", "", "Directory to write a JSON report of the run to")
+	htmlReport  = flag.Bool("html-report", false, "Also write the report as HTML (requires -report-dir)")
+	configPath  = flag.String("config", "/etc/movephoto_config.yml", "Configuration file of movephoto to take dateSources and timeShifts from, empty for the defaults of movephoto")
+	dateSources = flag.String("date-sources", "", "Comma-separated date sources tried in order: EXIF tag names, gps, filename, folderName or mtime (default dateSources.photos of the config)")
+	earliest    = flag.String("earliest", "", "Ignore dates before this day (YYYY-MM-DD) as bogus, empty for no limit (default dateSources.earliest of the config)")
+	maxFuture   = flag.Duration("max-future", 0, "Ignore dates further than this ahead of now as bogus, 0 for no limit (default dateSources.maxFuture of the config)")
+	backend     = flag.String("metadata-backend", metadata.Auto, "How metadata is read: native, exiftool, or auto for native with ExifTool for other formats if installed")
+	includes    patternList
+	excludes    patternList
+)
+
+// The date sources, window of believable dates, camera clock corrections and
+// metadata reader, from the movephoto config and the flags
+var (
+	sources []string
+	window  dates.Window
+	shifts  []dates.TimeShift
+	reader  metadata.Reader
+)
+
+// sharedConfig holds the settings of the movephoto configuration file that
+// dedupe uses as well
+type sharedConfig struct {
+	DateSources struct {
+		Photos    []string      `yaml:"photos"`
+		Earliest  string        `yaml:"earliest"`
+		MaxFuture time.Duration `yaml:"maxFuture"`
+	} `yaml:"dateSources"`
+	TimeShifts []dates.TimeShift `yaml:"timeShifts"`
+}
+
+// loadSharedConfig reads the settings dedupe shares with movephoto from the
+// movephoto configuration file at path, on top of the defaults of movephoto.
+// The default path may be missing, a path given with -config may not.
+func loadSharedConfig(path string, required bool) (sharedConfig, error) {
+	var config sharedConfig
+	config.DateSources.Photos = []string{"DateTimeOriginal", "CreateDate", "ModifyDate", "DateTimeDigitized", dates.Filename}
+	config.DateSources.Earliest = "1980-01-01"
+	config.DateSources.MaxFuture = 24 * time.Hour
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		slog.Debug("No movephoto configuration found, using its defaults", "config", path)
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// defaultInclude matches the IMG_* photos the tool was written for, and their RAW files
+const defaultInclude = `re:(?i)^(IMG.*)\.(jpg|jpeg|png|gif|bmp|cr2|cr3|nef|arw|raf|orf|rw2|dng)$`
+
+// rawExtensions are the camera RAW formats. A RAW file and the JPEG the
+// camera took alongside share their metadata but are no duplicates.
+var rawExtensions = map[string]bool{".cr2": true, ".cr3": true, ".nef": true, ".arw": true, ".raf": true, ".orf": true, ".rw2": true, ".dng": true}
+
+// patternList collects a repeatable pattern flag
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func init() {
+	flag.Var(&includes, "include", "Only process files matching this glob, or regex prefixed with re: (repeatable, defaults to IMG* photos and RAW files)")
+	flag.Var(&excludes, "exclude", "Skip files matching this glob, or regex prefixed with re: (repeatable)")
+}
+
+// logOptions are the shared logging flags
+var logOptions = logging.AddFlags(flag.CommandLine)
+
+func main() {
+	flag.Parse()
+
+	if *verbose {
+		logOptions.Level = "debug"
+	}
+	closeLog, err := logging.Setup(*logOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	defer closeLog()
+
+	if *targetDir == "" {
+		logging.Fatal("Please provide the path to the destination directory using the -dir flag.")
+	}
+
+	if len(includes) == 0 {
+		includes = patternList{defaultInclude}
+	}
+	fileFilter, err := filter.New(includes, excludes)
+	if err != nil {
+		logging.Fatal("Invalid filter", logging.Err(err))
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	config, err := loadSharedConfig(*configPath, set["config"])
+	if err != nil {
+		logging.Fatal("Failed to read the movephoto configuration", logging.Err(err))
+	}
+	sources = config.DateSources.Photos
+	if set["date-sources"] {
+		sources = strings.Split(*dateSources, ",")
+	} else if !slices.Contains(sources, dates.Mtime) {
+		// The importer leaves undated files to its undated fallbacks, dedupe
+		// renames them by their modification time as it always has
+		sources = append(sources, dates.Mtime)
+	}
+	for i, source := range sources {
+		sources[i] = strings.TrimSpace(source)
+		if err := dates.CheckSource(sources[i]); err != nil {
+			logging.Fatal("Invalid date sources", logging.Err(err))
+		}
+	}
+	window.MaxFuture = config.DateSources.MaxFuture
+	if set["max-future"] {
+		window.MaxFuture = *maxFuture
+	}
+	earliestDay := config.DateSources.Earliest
+	if set["earliest"] {
+		earliestDay = *earliest
+	}
+	if earliestDay != "" {
+		if window.Earliest, err = time.Parse("2006-01-02", earliestDay); err != nil {
+			logging.Fatal("Invalid earliest date, expected YYYY-MM-DD", "earliest", earliestDay)
+		}
+	}
+
+	shifts = config.TimeShifts
+	for _, t := range shifts {
+		if t.Make == "" && t.Model == "" && t.Serial == "" {
+			logging.Fatal("Invalid time shift, it needs a make, model or serial", "shift", t.Shift)
+		}
+		if _, err := dates.ParseShift(t.Shift); err != nil {
+			logging.Fatal("Invalid time shift", logging.Err(err))
+		}
+	}
+
+	if reader, err = metadata.New(*backend); err != nil {
+		logging.Fatal("Invalid -metadata-backend", logging.Err(err))
+	}
+
+	summary := report.New("dedupe", "removed", "renamed", "failed")
+	if *dryRun {
+		summary = report.New("dedupe", "would remove", "would rename", "failed")
+	}
+	err = processDirectory(*targetDir, fileFilter, summary)
+	if err != nil {
+		logging.Fatal("Error processing directories", logging.Err(err))
+	}
+	summary.Finish()
+	printSummary(summary)
+}
+
+func processDirectory(dirPath string, fileFilter *filter.Filter, summary *report.Report) error {
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Processing directory", "dir", dirPath, "files", len(files))
+
+	// Map to store unique identifiers and associated file paths
+	uniqueMap := make(map[string][]string)
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		// Skip files smaller than the minimum size
+		if file.Size() < *minFileSize {
+			slog.Debug("Skipping file", "file", file.Name(), "reason", "too small", "size", file.Size())
+			summary.Skip("too small")
+			continue
+		}
+		if *maxFileSize > 0 && file.Size() > *maxFileSize {
+			slog.Debug("Skipping file", "file", file.Name(), "reason", "too large", "size", file.Size())
+			summary.Skip("too large")
+			continue
+		}
+
+		fileName := file.Name()
+		slog.Debug("Checking file", "file", fileName)
+
+		if ok, reason := fileFilter.Match(fileName); !ok {
+			slog.Debug("Skipping file", "file", fileName, "reason", reason)
+			summary.Skip("filtered")
+			continue
+		}
+
+		slog.Debug("Processing file", "file", fileName)
+
+		filePath := filepath.Join(dirPath, fileName)
+
+		uniqueID, err := computeUniqueID(filePath)
+		if err != nil {
+			slog.Error("Error computing unique ID", "source", filePath, logging.Err(err))
+			summary.Skip("unreadable")
+			continue
+		}
+
+		slog.Debug("Computed unique ID", "source", filePath, "id", uniqueID)
+
+		uniqueMap[uniqueID] = append(uniqueMap[uniqueID], filePath)
+	}
+
+	// Remove duplicates
+	for uniqueID, filePaths := range uniqueMap {
+		if len(filePaths) > 1 {
+			// Sort file paths to determine which one to keep
+			sortFilesByMetadata(filePaths)
+
+			filesToDelete := filePaths[1:]
+
+			slog.Debug("Found duplicates", "id", uniqueID, "duplicates", len(filesToDelete))
+
+			for _, filePath := range filesToDelete {
+				var size int64
+				if info, err := os.Stat(filePath); err == nil {
+					size = info.Size()
+				}
+				if *dryRun {
+					slog.Info("Would delete duplicate file", "source", filePath, "action", "delete", "kept", filePaths[0])
+					summary.Add("would remove", size)
+				} else {
+					if *trashDir != "" {
+						// Move file to trash directory
+						err := moveToTrash(filePath, *trashDir)
+						if err != nil {
+							slog.Error("Error moving file to trash", "source", filePath, "action", "trash", logging.Err(err))
+							summary.Fail(report.Failure{Source: filePath, Destination: *trashDir, Action: "trash", Error: err.Error()})
+						} else {
+							slog.Info("Moved duplicate file to trash", "source", filePath, "destination", *trashDir, "action", "trash", "kept", filePaths[0])
+							summary.Add("removed", size)
+						}
+					} else {
+						err := os.Remove(filePath)
+						if err != nil {
+							slog.Error("Error deleting file", "source", filePath, "action", "delete", logging.Err(err))
+							summary.Fail(report.Failure{Source: filePath, Action: "delete", Error: err.Error()})
+						} else {
+							slog.Info("Deleted duplicate file", "source", filePath, "action", "delete", "kept", filePaths[0])
+							summary.Add("removed", size)
+						}
+					}
+				}
+			}
+			// Keep only the first file
+			uniqueMap[uniqueID] = filePaths[:1]
+		}
+	}
+
+	// Map to keep track of intended new filenames to avoid conflicts
+	intendedNames := make(map[string]string)   // Map from current file path to intended new filename
+	existingNames := make(map[string]struct{}) // Set of intended new filenames
+
+	// Build intended new filenames for all files
+	for _, filePaths := range uniqueMap {
+		for _, filePath := range filePaths {
+			newFileName, err := generateUniqueFileName(filePath, existingNames)
+			if err != nil {
+				slog.Error("Error generating new filename", "source", filePath, logging.Err(err))
+				summary.Fail(report.Failure{Source: filePath, Action: "rename", Error: err.Error()})
+				continue
+			}
+
+			intendedNames[filePath] = newFileName
+			existingNames[newFileName] = struct{}{}
+		}
+	}
+
+	// Now perform the renaming
+	for filePath, newFileName := range intendedNames {
+		renamed, err := performRename(filePath, newFileName)
+		if err != nil {
+			slog.Error("Error renaming file", "source", filePath, "action", "rename", logging.Err(err))
+			summary.Fail(report.Failure{Source: filePath, Destination: filepath.Join(filepath.Dir(filePath), newFileName), Action: "rename", Error: err.Error()})
+		} else if renamed && *dryRun {
+			summary.Add("would rename", 0)
+		} else if renamed {
+			summary.Add("renamed", 0)
+		}
+	}
+
+	return nil
+}
+
+// printSummary reports what the run did and writes the report to -report-dir
+func printSummary(summary *report.Report) {
+	slog.Info("Dedupe summary", "summary", summary.String(), "bytes", summary.TotalBytes(), "duration", summary.Elapsed())
+	for _, f := range summary.FailureList() {
+		slog.Warn("Failed file", "source", f.Source, "destination", f.Destination, "action", f.Action, "error", f.Error)
+	}
+
+	if *reportDir == "" {
+		return
+	}
+	path, err := summary.Write(*reportDir, *htmlReport)
+	if err != nil {
+		slog.Error("Failed to write report", "dir", *reportDir, logging.Err(err))
+		return
+	}
+	slog.Info("Wrote report", "path", path)
+}
+
+func computeUniqueID(filePath string) (string, error) {
+	// Attempt to read the metadata
+	fields, err := reader.Read(filePath)
+	if err != nil || fields.String("DateTimeOriginal", "ImageUniqueID") == "" {
+		// Without metadata that tells shots apart, fall back to computing checksum
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		return computeChecksum(data), nil
+	}
+
+	// Concatenate the fields that uniquely identify the photo, and the RAW
+	// format for RAW files
+	format := strings.ToLower(filepath.Ext(filePath))
+	if !rawExtensions[format] {
+		format = ""
+	}
+	uniqueString := fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v", fields.String("Make"), fields.String("Model"), fields.String("DateTimeOriginal"),
+		fields.String("LensModel"), fields.String("ImageUniqueID"), fields.String("BodySerialNumber"), format)
+
+	slog.Debug("Read metadata", "source", filePath, "metadata", uniqueString)
+
+	// Generate MD5 hash of the unique string
+	hash := md5.Sum([]byte(uniqueString))
+	uniqueID := hex.EncodeToString(hash[:])
+
+	return uniqueID, nil
+}
+
+func computeChecksum(data []byte) string {
+	hash := md5.Sum(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func generateUniqueFileName(filePath string, existingNames map[string]struct{}) (string, error) {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if ext == "" {
+		return "", fmt.Errorf("file %s has no extension", filePath)
+	}
+
+	timestamp, err := getPhotoTimestamp(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Start with base filename
+	baseName := fmt.Sprintf("IMG_%s", timestamp.Format("20060102_150405"))
+
+	// Counter for duplicate filenames
+	counter := 0
+	var newFileName string
+
+	for {
+		if counter == 0 {
+			newFileName = fmt.Sprintf("%s%s", baseName, ext)
+		} else {
+			newFileName = fmt.Sprintf("%s_%d%s", baseName, counter, ext)
+		}
+
+		// Check if the filename already exists in existingNames map
+		if _, exists := existingNames[newFileName]; !exists {
+			// Filename is unique
+			break
+		}
+
+		counter++
+	}
+
+	// Replace any invalid characters (e.g., ':' on Windows)
+	newFileName = strings.ReplaceAll(newFileName, ":", "")
+	return newFileName, nil
+}
+
+// performRename renames filePath to newFileName in the same directory,
+// reporting whether the name changed
+func performRename(filePath, newFileName string) (bool, error) {
+	dir := filepath.Dir(filePath)
+	newFilePath := filepath.Join(dir, newFileName)
+
+	currentFileName := filepath.Base(filePath)
+	if currentFileName == newFileName {
+		// File already has the correct name
+		slog.Debug("File already has the correct name", "source", filePath)
+		return false, nil
+	}
+
+	if *dryRun {
+		slog.Info("Would rename file", "source", filePath, "destination", newFilePath, "action", "rename")
+		return true, nil
+	}
+
+	err := os.Rename(filePath, newFilePath)
+	if err != nil {
+		return false, err
+	}
+	slog.Info("Renamed file", "source", filePath, "destination", newFilePath, "action", "rename")
+	return true, nil
+}
+
+func moveToTrash(filePath, trashDir string) error {
+	// Ensure trash directory exists
+	if _, err := os.Stat(trashDir); os.IsNotExist(err) {
+		err = os.MkdirAll(trashDir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	fileName := filepath.Base(filePath)
+	destination := filepath.Join(trashDir, fileName)
+
+	// Avoid overwriting files in the trash directory
+	for i := 1; ; i++ {
+		if _, err := os.Stat(destination); os.IsNotExist(err) {
+			break
+		}
+		destination = filepath.Join(trashDir, fmt.Sprintf("%s_%d", fileName, i))
+	}
+
+	return os.Rename(filePath, destination)
+}
+
+func sortFilesByMetadata(filePaths []string) {
+	sort.Slice(filePaths, func(i, j int) bool {
+		t1, err1 := getPhotoTimestamp(filePaths[i])
+		t2, err2 := getPhotoTimestamp(filePaths[j])
+		if err1 != nil || err2 != nil {
+			return filePaths[i] < filePaths[j]
+		}
+		return t1.Before(t2)
+	})
+}
+
+// getPhotoTimestamp dates a photo by the first of the date sources that has a
+// believable date, correcting the camera clock by the timeShifts entry of the
+// movephoto config that matches the camera
+func getPhotoTimestamp(filePath string) (time.Time, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	meta, err := reader.Read(filePath)
+	if err != nil {
+		meta = metadata.Fields{} // Filenames and mtime can still date it
+	}
+	shift := dates.CameraShift(shifts, meta)
+	date, _, err := dates.Find(sources, window, dates.File{Path: filePath, ModTime: info.ModTime(), Meta: meta, Shift: shift})
+	return date, err
+}
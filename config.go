@@ -0,0 +1,587 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"movephoto/filter"
+	"movephoto/metadata"
+)
+
+// configProblem is one issue found in a config file
+type configProblem struct {
+	File    string // File, environment variable or flag the problem is in, if known
+	Line    int    // 0 when the problem isn't tied to a line
+	Message string
+	Warning bool // Warnings are reported but still leave a usable config
+}
+
+func (p configProblem) String() string {
+	severity := "error"
+	if p.Warning {
+		severity = "warning"
+	}
+	switch {
+	case p.File != "" && p.Line > 0:
+		return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, severity, p.Message)
+	case p.File != "":
+		return fmt.Sprintf("%s: %s: %s", p.File, severity, p.Message)
+	case p.Line > 0:
+		return fmt.Sprintf("line %d: %s: %s", p.Line, severity, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", severity, p.Message)
+}
+
+// readConfig reads the config file at path together with the layers around
+// it, see configLayers. Warnings are logged; any error makes the whole config invalid.
+func readConfig(path string) (Config, error) {
+	config, problems, err := parseConfig(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var errs []string
+	for _, problem := range problems {
+		if problem.Warning {
+			slog.Warn("Config warning", "problem", problem.String())
+		} else {
+			errs = append(errs, problem.String())
+		}
+	}
+	if len(errs) > 0 {
+		return Config{}, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return config, nil
+}
+
+// parseConfig merges the config layers of path, decodes them, normalizes the
+// result and checks it for problems
+func parseConfig(path string) (Config, []configProblem, error) {
+	config := Config{}
+
+	layers, problems, err := configLayers(path)
+	if err != nil {
+		return config, nil, err
+	}
+	root := mergeLayers(layers)
+
+	// yaml.v3 can only reject unknown fields when decoding straight from the
+	// input, so walk the tree ourselves to keep line numbers for every field
+	found := unknownFields(root, reflect.TypeOf(config))
+
+	// Type errors still decode everything else, so keep checking after them
+	err = root.Decode(&config)
+	if err != nil {
+		found = append(found, yamlProblems(err)...)
+	}
+	if _, ok := err.(*yaml.TypeError); err == nil || ok {
+		found = append(found, normalizeConfig(&config, root)...)
+		found = append(found, checkConfig(config, root)...)
+	}
+
+	// Until here line numbers count through all layers, turn them back into
+	// lines of the file, or the variable or flag, the value came from
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Line < found[j].Line
+	})
+	for i := range found {
+		if found[i].Line == 0 {
+			continue
+		}
+		layer, line := locate(layers, found[i].Line)
+		found[i].File, found[i].Line = layer.name, line
+		if !layer.file {
+			found[i].Line = 0
+		}
+	}
+	return config, append(problems, found...), nil
+}
+
+// yamlLinePattern extracts the line number from yaml.v3 error messages
+var yamlLinePattern = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlProblems turns a yaml.v3 decoding error into problems with line numbers
+func yamlProblems(err error) []configProblem {
+	var messages []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	var problems []configProblem
+	for _, message := range messages {
+		problem := configProblem{Message: strings.TrimPrefix(message, "yaml: ")}
+		if m := yamlLinePattern.FindStringSubmatch(message); m != nil {
+			problem.Line, _ = strconv.Atoi(m[1])
+			problem.Message = m[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// unknownFields reports every mapping key in node that has no matching yaml
+// field in t, recursing into nested structs, slices and maps
+func unknownFields(node *yaml.Node, t reflect.Type) []configProblem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var problems []configProblem
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			problems = append(problems, unknownFields(child, t)...)
+		}
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := yamlFields(t)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				fieldType, ok := fields[key.Value]
+				if !ok {
+					problems = append(problems, configProblem{Line: key.Line, Message: fmt.Sprintf("unknown field %q in %s", key.Value, t.Name())})
+					continue
+				}
+				problems = append(problems, unknownFields(value, fieldType)...)
+			}
+		case reflect.Map:
+			for i := 1; i < len(node.Content); i += 2 {
+				problems = append(problems, unknownFields(node.Content[i], t.Elem())...)
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, child := range node.Content {
+				problems = append(problems, unknownFields(child, t.Elem())...)
+			}
+		}
+	}
+	return problems
+}
+
+// yamlFields maps the yaml keys of struct type t to their field types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // Unexported
+		}
+		tag := field.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(opts, "inline") {
+			for key, fieldType := range yamlFields(field.Type) {
+				fields[key] = fieldType
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// findNode follows a path of mapping keys (strings) and sequence indexes (ints)
+// from node, returning nil if it doesn't exist
+func findNode(node *yaml.Node, path ...interface{}) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, step := range path {
+		if node == nil {
+			return nil
+		}
+		switch step := step.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				return nil
+			}
+			var next *yaml.Node
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == step {
+					next = node.Content[i+1]
+				}
+			}
+			node = next
+		case int:
+			if node.Kind != yaml.SequenceNode || step >= len(node.Content) {
+				return nil
+			}
+			node = node.Content[step]
+		}
+	}
+	return node
+}
+
+// lineOf returns the line of the node at path, or of its closest existing parent
+func lineOf(root *yaml.Node, path ...interface{}) int {
+	for len(path) > 0 {
+		if node := findNode(root, path...); node != nil {
+			return node.Line
+		}
+		path = path[:len(path)-1]
+	}
+	return 0
+}
+
+// normalizeConfig lowercases extensions and adds their leading dot, since
+// hasExtension compares against the lowercased ".ext" of each file
+func normalizeConfig(config *Config, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	normalize := func(extensions []string, path ...interface{}) []string {
+		if extensions == nil {
+			return nil // Not set, inherited from the top level
+		}
+		key := path[len(path)-1]
+		normalized := make([]string, 0, len(extensions))
+		for i, ext := range extensions {
+			fixed := strings.ToLower(strings.TrimSpace(ext))
+			if fixed != "" && !strings.HasPrefix(fixed, ".") {
+				fixed = "." + fixed
+			}
+			if fixed != ext {
+				problems = append(problems, configProblem{Line: lineOf(root, append(path, i)...), Message: fmt.Sprintf("%s entry %q should be written as %q", key, ext, fixed), Warning: true})
+			}
+			normalized = append(normalized, fixed)
+		}
+		return normalized
+	}
+	withHEIC := func(extensions []string) []string {
+		// Add .heic to the list of image extensions
+		if extensions != nil && !hasExtension("x.heic", extensions) {
+			extensions = append(extensions, ".heic")
+		}
+		return extensions
+	}
+
+	config.ImageExtensions = withHEIC(normalize(config.ImageExtensions, "imageExtensions"))
+	if config.ImageExtensions == nil {
+		config.ImageExtensions = []string{".heic"}
+	}
+	config.VideoExtensions = normalize(config.VideoExtensions, "videoExtensions")
+	config.RawExtensions = normalize(config.RawExtensions, "rawExtensions")
+	config.BannedExtensions = normalize(config.BannedExtensions, "bannedExtensions")
+	for i := range config.WatchDirs {
+		watchDir := &config.WatchDirs[i]
+		watchDir.ImageExtensions = withHEIC(normalize(watchDir.ImageExtensions, "watchDirs", i, "imageExtensions"))
+		watchDir.VideoExtensions = normalize(watchDir.VideoExtensions, "watchDirs", i, "videoExtensions")
+		watchDir.RawExtensions = normalize(watchDir.RawExtensions, "watchDirs", i, "rawExtensions")
+		watchDir.BannedExtensions = normalize(watchDir.BannedExtensions, "watchDirs", i, "bannedExtensions")
+	}
+	return problems
+}
+
+// checkConfig looks for settings that decode fine but can't work
+func checkConfig(config Config, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	add := func(line int, warning bool, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Line: line, Message: fmt.Sprintf(format, args...), Warning: warning})
+	}
+
+	if config.DefaultDestinationDir == "" {
+		add(0, false, "defaultDestinationDir is not set")
+	} else if info, err := os.Stat(config.DefaultDestinationDir); err != nil {
+		add(lineOf(root, "defaultDestinationDir"), true, "defaultDestinationDir %s does not exist yet and will be created", config.DefaultDestinationDir)
+	} else if !info.IsDir() {
+		add(lineOf(root, "defaultDestinationDir"), false, "defaultDestinationDir %s is not a directory", config.DefaultDestinationDir)
+	}
+
+	if err := checkTemplate(config.DestinationTemplate); err != nil {
+		add(lineOf(root, "destinationTemplate"), false, "%v", err)
+	}
+	if err := checkTemplate(config.RawDestinationTemplate); err != nil {
+		add(lineOf(root, "rawDestinationTemplate"), false, "%v", err)
+	}
+	if config.MinFileSize != nil && *config.MinFileSize < 0 {
+		add(lineOf(root, "minFileSize"), false, "minFileSize must not be negative")
+	}
+	if config.MaxFileSize < 0 {
+		add(lineOf(root, "maxFileSize"), false, "maxFileSize must not be negative")
+	}
+
+	// A file type can't be imported and purged at the same time
+	problems = append(problems, checkExtensionOverlap(config.ImageExtensions, config.VideoExtensions, config.RawExtensions, config.BannedExtensions, func(key string, i int) int {
+		return lineOf(root, key, i)
+	})...)
+
+	problems = append(problems, checkPatterns(config.IncludePatterns, config.ExcludePatterns, func(key string) int {
+		return lineOf(root, key)
+	})...)
+
+	if len(config.WatchDirs) == 0 {
+		add(lineOf(root, "watchDirs"), false, "no watchDirs configured")
+	}
+	if config.DefaultDestinationDir != "" {
+		problems = append(problems, checkDestinationOverlap(config, config.DefaultDestinationDir, lineOf(root, "defaultDestinationDir"))...)
+	}
+	seen := make(map[string]bool)
+	for i, watchDir := range config.WatchDirs {
+		if watchDir.Path == "" {
+			add(lineOf(root, "watchDirs", i), false, "watch directory without a path")
+			continue
+		}
+		pathLine := lineOf(root, "watchDirs", i, "path")
+		if seen[filepath.Clean(watchDir.Path)] {
+			add(pathLine, false, "watch directory %s is listed more than once", watchDir.Path)
+		}
+		seen[filepath.Clean(watchDir.Path)] = true
+
+		if watchDir.Action != "move" && watchDir.Action != "copy" {
+			add(lineOf(root, "watchDirs", i, "action"), false, "unknown action %q for watch directory %s, expected move or copy", watchDir.Action, watchDir.Path)
+		}
+		if info, err := os.Stat(watchDir.Path); err != nil {
+			add(pathLine, true, "watch directory %s does not exist", watchDir.Path)
+		} else if !info.IsDir() {
+			add(pathLine, false, "watch directory %s is not a directory", watchDir.Path)
+		}
+
+		if len(watchDir.IncludePrefix) > 0 {
+			add(lineOf(root, "watchDirs", i, "includePrefix"), true, "includePrefix is deprecated, use includePatterns: %q", filter.PrefixPatterns(watchDir.IncludePrefix))
+		}
+		problems = append(problems, checkPatterns(watchDir.IncludePatterns, watchDir.ExcludePatterns, func(key string) int {
+			return lineOf(root, "watchDirs", i, key)
+		})...)
+
+		settings := resolveWatchDir(config, watchDir)
+		if watchDir.Destination != "" {
+			if info, err := os.Stat(watchDir.Destination); err != nil {
+				add(lineOf(root, "watchDirs", i, "destination"), true, "destination %s of watch directory %s does not exist yet and will be created", watchDir.Destination, watchDir.Path)
+			} else if !info.IsDir() {
+				add(lineOf(root, "watchDirs", i, "destination"), false, "destination %s of watch directory %s is not a directory", watchDir.Destination, watchDir.Path)
+			}
+		}
+		if err := checkTemplate(watchDir.DestinationTemplate); err != nil {
+			add(lineOf(root, "watchDirs", i, "destinationTemplate"), false, "%v", err)
+		}
+		if err := checkTemplate(watchDir.RawDestinationTemplate); err != nil {
+			add(lineOf(root, "watchDirs", i, "rawDestinationTemplate"), false, "%v", err)
+		}
+		for _, media := range []struct {
+			name   string
+			limits mediaLimits
+		}{{"photos", settings.Photos}, {"videos", settings.Videos}} {
+			limits := media.limits
+			if limits.MinFileSize < 0 || limits.MaxFileSize < 0 || limits.MinDimension < 0 || limits.MinDuration < 0 {
+				add(lineOf(root, "watchDirs", i), false, "limits for %s of watch directory %s must not be negative", media.name, watchDir.Path)
+			}
+			if limits.MaxFileSize > 0 && limits.MinFileSize > limits.MaxFileSize {
+				add(lineOf(root, "watchDirs", i), false, "minFileSize %d is larger than maxFileSize %d for %s of watch directory %s", limits.MinFileSize, limits.MaxFileSize, media.name, watchDir.Path)
+			}
+		}
+
+		if watchDir.Destination != "" {
+			problems = append(problems, checkDestinationOverlap(config, watchDir.Destination, lineOf(root, "watchDirs", i, "destination"))...)
+		}
+		if watchDir.UnknownDate != nil {
+			problems = append(problems, checkUnknownDate(*watchDir.UnknownDate, root, "watchDirs", i, "unknownDate")...)
+		}
+
+		if watchDir.ImageExtensions != nil || watchDir.VideoExtensions != nil || watchDir.RawExtensions != nil || watchDir.BannedExtensions != nil {
+			images := config.ImageExtensions
+			if watchDir.ImageExtensions != nil {
+				images = watchDir.ImageExtensions // settings has them without the RAW extensions
+			}
+			problems = append(problems, checkExtensionOverlap(images, settings.VideoExtensions, settings.RawExtensions, settings.BannedExtensions, func(key string, j int) int {
+				return lineOf(root, "watchDirs", i, key)
+			})...)
+		}
+	}
+
+	switch config.Verify {
+	case "", "hash", "size", "none":
+	default:
+		add(lineOf(root, "verify"), false, "unknown verify policy %q, expected hash, size or none", config.Verify)
+	}
+	if config.Checksum != "" {
+		if _, err := newHash(config.Checksum); err != nil {
+			add(lineOf(root, "checksum"), false, "%v", err)
+		}
+	}
+	switch config.MoveStrategy {
+	case "", "auto", "copy":
+	default:
+		add(lineOf(root, "moveStrategy"), false, "unknown moveStrategy %q, expected auto or copy", config.MoveStrategy)
+	}
+	if _, err := metadata.New(config.MetadataBackend); err != nil {
+		add(lineOf(root, "metadataBackend"), false, "%v", err)
+	}
+	if config.Workers < 0 {
+		add(lineOf(root, "workers"), false, "workers must not be negative")
+	}
+	if config.DeviceWorkers < 0 {
+		add(lineOf(root, "deviceWorkers"), false, "deviceWorkers must not be negative")
+	}
+
+	if config.MetricsAddress != "" {
+		if err := checkListenAddress("metricsAddress", config.MetricsAddress); err != nil {
+			add(lineOf(root, "metricsAddress"), false, "%v", err)
+		}
+	}
+	if config.APIAddress != "" {
+		if err := checkListenAddress("apiAddress", config.APIAddress); err != nil {
+			add(lineOf(root, "apiAddress"), false, "%v", err)
+		} else if !isLoopback(config.APIAddress) {
+			add(lineOf(root, "apiAddress"), true, "apiAddress %s is reachable from other machines, but the API has no authentication", config.APIAddress)
+		}
+	}
+
+	if config.HTMLReports && config.ReportsDir == "" {
+		add(lineOf(root, "htmlReports"), true, "htmlReports has no effect without reportsDir")
+	}
+
+	if config.Failures.MaxAttempts < 0 {
+		add(lineOf(root, "failures", "maxAttempts"), false, "failures.maxAttempts must not be negative")
+	}
+	if config.Failures.Backoff < 0 || config.Failures.MaxBackoff < 0 {
+		add(lineOf(root, "failures"), false, "failures.backoff and failures.maxBackoff must not be negative")
+	}
+
+	problems = append(problems, checkDateSources(config, root)...)
+	problems = append(problems, checkTimeShifts(config, root)...)
+	problems = append(problems, checkUnknownDate(config.UnknownDate, root, "unknownDate")...)
+	problems = append(problems, checkRules(config, root)...)
+	problems = append(problems, checkHooks(config, root)...)
+	problems = append(problems, checkPlatformSupport(config, root)...)
+
+	if config.LockFilePath != "" {
+		if _, err := os.Stat(filepath.Dir(config.LockFilePath)); err != nil {
+			add(lineOf(root, "lockFilePath"), false, "directory of lockFilePath %s does not exist", config.LockFilePath)
+		}
+	}
+	return problems
+}
+
+// checkDestinationOverlap reports watch directories that contain destination
+// or lie inside it, which would make the importer pick up its own output
+func checkDestinationOverlap(config Config, destination string, line int) []configProblem {
+	var problems []configProblem
+	for _, watchDir := range config.WatchDirs {
+		if watchDir.Path == "" {
+			continue
+		}
+		if isWithin(destination, watchDir.Path) {
+			problems = append(problems, configProblem{Line: line, Message: fmt.Sprintf("destination %s is inside watch directory %s", destination, watchDir.Path)})
+		} else if isWithin(watchDir.Path, destination) {
+			problems = append(problems, configProblem{Line: line, Message: fmt.Sprintf("watch directory %s is inside destination %s", watchDir.Path, destination)})
+		}
+	}
+	return problems
+}
+
+// checkExtensionOverlap reports extensions that are in more than one of the
+// image, video, RAW and banned lists. lineOf locates entry i of the list named
+// key. RAW formats listed as images as well only get a warning, since they
+// were imported as images before rawExtensions existed.
+func checkExtensionOverlap(images, videos, raws, banned []string, lineOf func(key string, i int) int) []configProblem {
+	var problems []configProblem
+	for i, ext := range banned {
+		if hasExtension("x"+ext, images) {
+			problems = append(problems, configProblem{Line: lineOf("bannedExtensions", i), Message: fmt.Sprintf("%s is both banned and listed in imageExtensions", ext)})
+		}
+		if hasExtension("x"+ext, videos) {
+			problems = append(problems, configProblem{Line: lineOf("bannedExtensions", i), Message: fmt.Sprintf("%s is both banned and listed in videoExtensions", ext)})
+		}
+		if hasExtension("x"+ext, raws) {
+			problems = append(problems, configProblem{Line: lineOf("bannedExtensions", i), Message: fmt.Sprintf("%s is both banned and listed in rawExtensions", ext)})
+		}
+	}
+	for i, ext := range videos {
+		if hasExtension("x"+ext, images) {
+			problems = append(problems, configProblem{Line: lineOf("videoExtensions", i), Message: fmt.Sprintf("%s is listed in both imageExtensions and videoExtensions", ext)})
+		}
+		if hasExtension("x"+ext, raws) {
+			problems = append(problems, configProblem{Line: lineOf("videoExtensions", i), Message: fmt.Sprintf("%s is listed in both rawExtensions and videoExtensions", ext)})
+		}
+	}
+	for i, ext := range images {
+		if hasExtension("x"+ext, raws) {
+			problems = append(problems, configProblem{Line: lineOf("imageExtensions", i), Message: fmt.Sprintf("%s is listed in both imageExtensions and rawExtensions, it is imported as a RAW file", ext), Warning: true})
+		}
+	}
+	return problems
+}
+
+// checkPatterns reports include and exclude patterns that don't compile
+func checkPatterns(include, exclude []string, lineOf func(key string) int) []configProblem {
+	var problems []configProblem
+	if _, err := filter.New(include, nil); err != nil {
+		problems = append(problems, configProblem{Line: lineOf("includePatterns"), Message: err.Error()})
+	}
+	if _, err := filter.New(nil, exclude); err != nil {
+		problems = append(problems, configProblem{Line: lineOf("excludePatterns"), Message: err.Error()})
+	}
+	return problems
+}
+
+// isWithin reports whether path is dir itself or somewhere below it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// runConfigCommand implements the "config" subcommands and returns the exit code
+func runConfigCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: movephoto [flags] config check|show")
+		return 2
+	}
+
+	switch args[0] {
+	case "check":
+		return checkConfigFile(*configFilePath)
+	case "show":
+		return runShowConfig(*configFilePath)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown config command %q\n", args[0])
+		return 2
+	}
+}
+
+// checkConfigFile prints every problem in the config file at path
+func checkConfigFile(path string) int {
+	_, problems, err := parseConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if path == "" {
+		path = "config" // Only environment variables and -set flags
+	}
+
+	errorCount := 0
+	for _, problem := range problems {
+		if !problem.Warning {
+			errorCount++
+		}
+		if problem.File == "" {
+			problem.File = path
+		}
+		fmt.Println(problem)
+	}
+
+	if errorCount > 0 {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", path, errorCount, len(problems)-errorCount)
+		return 1
+	}
+	fmt.Printf("%s: OK (%d warning(s))\n", path, len(problems))
+	return 0
+}
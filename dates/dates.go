@@ -0,0 +1,272 @@
+// Package dates works out when a photo or video was taken from an ordered list
+// of date sources, shared by movephoto and the dedupe tool.
+package dates
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date sources that aren't metadata tags. Any other source is the ExifTool
+// name of a tag, such as DateTimeOriginal or SubSecDateTimeOriginal.
+const (
+	Filename   = "filename"   // A date in the filename of an iPhone or Pixel shot
+	FolderName = "folderName" // A date in the name of the containing folder or a parent
+	Mtime      = "mtime"      // The modification time of the file
+	GPS        = "gps"        // The GPS timestamp, in UTC
+)
+
+// Metadata looks up metadata tags by their ExifTool names, returning the first
+// of tags that is set or an empty string
+type Metadata interface {
+	String(tags ...string) string
+}
+
+// File is the file being dated
+type File struct {
+	Path    string
+	ModTime time.Time
+	Meta    Metadata // Nil if the metadata couldn't be read
+	Shift   Shift    // Correction of the camera clock, see CameraClock
+}
+
+// Window is the range of dates that are believable. Cameras with a flat
+// clock battery write dates such as 0000:00:00 or 1970:01:01.
+type Window struct {
+	Earliest  time.Time     // Zero means no limit
+	MaxFuture time.Duration // How far past the current time a date may be, 0 means no limit
+}
+
+// Check returns an error if date is outside the window
+func (w Window) Check(date time.Time) error {
+	if date.Year() < 1 {
+		return fmt.Errorf("date %s is not set", date.Format(time.DateTime))
+	}
+	if !w.Earliest.IsZero() && date.Before(w.Earliest) {
+		return fmt.Errorf("date %s is before %s", date.Format(time.DateTime), w.Earliest.Format(time.DateOnly))
+	}
+	if w.MaxFuture > 0 && date.After(time.Now().Add(w.MaxFuture)) {
+		return fmt.Errorf("date %s is in the future", date.Format(time.DateTime))
+	}
+	return nil
+}
+
+// Find dates file by the first of sources that gives a date inside window,
+// returning the date and its source. Dates of the camera clock are shifted
+// before they are checked against the window.
+func Find(sources []string, window Window, file File) (time.Time, string, error) {
+	var rejected []string
+	for _, source := range sources {
+		date, ok := Date(source, file)
+		if !ok {
+			continue
+		}
+		if CameraClock(source) {
+			date = file.Shift.Apply(date)
+		}
+		if err := window.Check(date); err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+		return date, source, nil
+	}
+	if len(rejected) > 0 {
+		return time.Time{}, "", fmt.Errorf("no believable date found (%s)", strings.Join(rejected, "; "))
+	}
+	return time.Time{}, "", fmt.Errorf("no date found in %s", strings.Join(sources, ", "))
+}
+
+// Date returns the date source gives for file
+func Date(source string, file File) (time.Time, bool) {
+	switch source {
+	case Filename:
+		date, err := FromFilename(filepath.Base(file.Path))
+		return date, err == nil
+	case FolderName:
+		return FromFolder(filepath.Dir(file.Path))
+	case Mtime:
+		return file.ModTime, !file.ModTime.IsZero()
+	}
+	if file.Meta == nil {
+		return time.Time{}, false
+	}
+	var value string
+	if source == GPS {
+		value = gpsValue(file.Meta)
+	} else {
+		value = tagValue(file.Meta, source)
+	}
+	if value == "" {
+		return time.Time{}, false
+	}
+	date, err := ParseTag(value)
+	return date, err == nil
+}
+
+// subSecTags are the tags ExifTool combines into its SubSec composite tags:
+// the date, the fraction of a second and the time zone offset
+var subSecTags = map[string][3]string{
+	"SubSecDateTimeOriginal": {"DateTimeOriginal", "SubSecTimeOriginal", "OffsetTimeOriginal"},
+	"SubSecCreateDate":       {"CreateDate", "SubSecTimeDigitized", "OffsetTimeDigitized"},
+	"SubSecModifyDate":       {"ModifyDate", "SubSecTime", "OffsetTime"},
+}
+
+// tagValue returns the value of tag. SubSec composite tags are put together
+// from their parts when the metadata doesn't have them.
+func tagValue(meta Metadata, tag string) string {
+	if value := meta.String(tag); value != "" {
+		return value
+	}
+	parts, ok := subSecTags[tag]
+	if !ok {
+		return ""
+	}
+	value := meta.String(parts[0])
+	if value == "" {
+		return ""
+	}
+	if subSec := meta.String(parts[1]); subSec != "" && !strings.Contains(value, ".") {
+		value += "." + subSec
+	}
+	return value + meta.String(parts[2])
+}
+
+// gpsValue returns the GPS timestamp as an ExifTool date in UTC
+func gpsValue(meta Metadata) string {
+	if value := meta.String("GPSDateTime"); value != "" {
+		return value
+	}
+	date, clock := meta.String("GPSDateStamp"), meta.String("GPSTimeStamp")
+	if date == "" || clock == "" {
+		return ""
+	}
+	return date + " " + clock + "Z"
+}
+
+// tagLayouts are the date formats found in metadata. Fractions of a second are
+// accepted after the seconds without being in the layout.
+var tagLayouts = []string{
+	"2006:01:02 15:04:05Z07:00",
+	"2006:01:02 15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006:01:02",
+}
+
+// ParseTag parses the date of a metadata tag. Times without a zone are taken
+// as they are, in UTC, so they land in the folder of the day they show.
+func ParseTag(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range tagLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", value)
+}
+
+// Filename patterns of iPhone and Pixel shots
+var (
+	iphonePattern = regexp.MustCompile(`(\d{8})_\d{9}_iOS`)
+	pixelPattern  = regexp.MustCompile(`PXL_(\d{8})_\d{9}`)
+)
+
+// FromFilename returns the date in the name of an iPhone or Pixel shot
+func FromFilename(name string) (time.Time, error) {
+	for _, pattern := range []*regexp.Regexp{iphonePattern, pixelPattern} {
+		if matches := pattern.FindStringSubmatch(name); matches != nil {
+			return time.Parse("20060102", matches[1])
+		}
+	}
+	return time.Time{}, fmt.Errorf("no date found in filename")
+}
+
+// folderDatePattern matches YYYY-MM-DD, YYYYMMDD and YYYY-MM in a folder name
+var folderDatePattern = regexp.MustCompile(`(?:^|\D)((?:19|20)\d{2})[-_.]?(0[1-9]|1[0-2])(?:[-_.]?(0[1-9]|[12]\d|3[01]))?(?:\D|$)`)
+
+// folderYearPattern matches a year on its own in a folder name
+var folderYearPattern = regexp.MustCompile(`(?:^|\D)((?:19|20)\d{2})(?:\D|$)`)
+
+// FromFolder returns the date in the name of dir or its closest parent that has one.
+// A missing day or month is taken as the first.
+func FromFolder(dir string) (time.Time, bool) {
+	for {
+		name := filepath.Base(dir)
+		if m := folderDatePattern.FindStringSubmatch(name); m != nil {
+			year, _ := strconv.Atoi(m[1])
+			month, _ := strconv.Atoi(m[2])
+			day := 1
+			if m[3] != "" {
+				day, _ = strconv.Atoi(m[3])
+			}
+			return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC), true
+		}
+		if m := folderYearPattern.FindStringSubmatch(name); m != nil {
+			year, _ := strconv.Atoi(m[1])
+			return time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC), true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return time.Time{}, false
+		}
+		dir = parent
+	}
+}
+
+// dateTags are the ExifTool names of the date tags a source can name: those
+// the native readers produce and the other dates ExifTool reads from photos
+// and videos
+var dateTags = []string{
+	"DateTimeOriginal", "CreateDate", "ModifyDate", "DateTimeDigitized",
+	"SubSecDateTimeOriginal", "SubSecCreateDate", "SubSecModifyDate",
+	"DateTimeCreated", "DateCreated", "DigitalCreationDateTime", "MetadataDate",
+	"GPSDateTime", "CreationDate", "ContentCreateDate",
+	"MediaCreateDate", "MediaModifyDate", "TrackCreateDate", "TrackModifyDate",
+}
+
+// CheckSource returns an error if source is neither a known source nor one
+// of dateTags, suggesting the name it is closest to
+func CheckSource(source string) error {
+	names := append([]string{Filename, FolderName, Mtime, GPS}, dateTags...)
+	best, bestDistance := "", 3 // Suggest names at most two edits away
+	for _, name := range names {
+		if name == source {
+			return nil
+		}
+		distance := editDistance(strings.ToLower(source), strings.ToLower(name))
+		if distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("unknown date source %q, did you mean %q?", source, best)
+	}
+	return fmt.Errorf("unknown date source %q, expected a date tag such as DateTimeOriginal or CreateDate, %s, %s, %s or %s", source, Filename, FolderName, Mtime, GPS)
+}
+
+// editDistance returns the number of single byte insertions, deletions and
+// substitutions that turn a into b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,30 @@
+package dates
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSource(t *testing.T) {
+	for _, source := range []string{"DateTimeOriginal", "SubSecCreateDate", "TrackCreateDate", Filename, FolderName, Mtime, GPS} {
+		if err := CheckSource(source); err != nil {
+			t.Errorf("CheckSource(%q): %v", source, err)
+		}
+	}
+	for source, suggestion := range map[string]string{
+		"filname":           `did you mean "filename"`,
+		"Mtime":             `did you mean "mtime"`,
+		"DateTimeOrignal":   `did you mean "DateTimeOriginal"`,
+		"createdate":        `did you mean "CreateDate"`,
+		"FileSize":          "expected a date tag",
+		"":                  "expected a date tag",
+		"DateTimeOriginal ": `did you mean "DateTimeOriginal"`,
+	} {
+		err := CheckSource(source)
+		if err == nil {
+			t.Errorf("CheckSource(%q) accepted it", source)
+		} else if !strings.Contains(err.Error(), suggestion) {
+			t.Errorf("CheckSource(%q) = %q, want it to say %q", source, err, suggestion)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package dates
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shift corrects the clock of a camera. Years, months and days are calendar
+// units, so a shift of a year lands on the same day of the month.
+type Shift struct {
+	Years, Months, Days int
+	Clock               time.Duration
+}
+
+// shiftPattern matches a shift such as +1y2mo3d4h5m6s or -90m
+var (
+	shiftPattern     = regexp.MustCompile(`^(?:[+-]?\d+(?:y|mo|d|h|m|s))+$`)
+	shiftPartPattern = regexp.MustCompile(`([+-]?)(\d+)(y|mo|d|h|m|s)`)
+)
+
+// ParseShift parses a shift of the form [+-]<n>y<n>mo<n>d<n>h<n>m<n>s, where
+// every part is optional. A sign applies to the parts after it, up to the next
+// sign.
+func ParseShift(s string) (Shift, error) {
+	s = strings.ReplaceAll(s, " ", "")
+	if !shiftPattern.MatchString(s) {
+		return Shift{}, fmt.Errorf("invalid shift %q, expected e.g. +1h, -30m or +1y2mo3d", s)
+	}
+	sign := 1
+	var shift Shift
+	for _, part := range shiftPartPattern.FindAllStringSubmatch(s, -1) {
+		switch part[1] {
+		case "+":
+			sign = 1
+		case "-":
+			sign = -1
+		}
+		n, err := strconv.Atoi(part[2])
+		if err != nil {
+			return Shift{}, fmt.Errorf("invalid shift %q: %v", s, err)
+		}
+		n *= sign
+		switch part[3] {
+		case "y":
+			shift.Years += n
+		case "mo":
+			shift.Months += n
+		case "d":
+			shift.Days += n
+		case "h":
+			shift.Clock += time.Duration(n) * time.Hour
+		case "m":
+			shift.Clock += time.Duration(n) * time.Minute
+		case "s":
+			shift.Clock += time.Duration(n) * time.Second
+		}
+	}
+	return shift, nil
+}
+
+// IsZero reports whether the shift changes nothing
+func (s Shift) IsZero() bool {
+	return s == Shift{}
+}
+
+// Apply returns t corrected by the shift
+func (s Shift) Apply(t time.Time) time.Time {
+	return t.AddDate(s.Years, s.Months, s.Days).Add(s.Clock)
+}
+
+// Plus returns the shift that applies s and then o
+func (s Shift) Plus(o Shift) Shift {
+	return Shift{Years: s.Years + o.Years, Months: s.Months + o.Months, Days: s.Days + o.Days, Clock: s.Clock + o.Clock}
+}
+
+// Signs reports whether any part of the shift moves dates forward and whether
+// any moves them back
+func (s Shift) Signs() (forward, back bool) {
+	for _, n := range []int64{int64(s.Years), int64(s.Months), int64(s.Days), int64(s.Clock)} {
+		forward = forward || n > 0
+		back = back || n < 0
+	}
+	return forward, back
+}
+
+// Negate returns the shift that undoes s
+func (s Shift) Negate() Shift {
+	return Shift{Years: -s.Years, Months: -s.Months, Days: -s.Days, Clock: -s.Clock}
+}
+
+// String formats the shift the way ParseShift reads it, with a sign wherever
+// the sign changes
+func (s Shift) String() string {
+	if s.IsZero() {
+		return "+0s"
+	}
+	var b strings.Builder
+	sign := ""
+	part := func(n int, unit string) {
+		if n == 0 {
+			return
+		}
+		partSign := "+"
+		if n < 0 {
+			partSign, n = "-", -n
+		}
+		if partSign != sign {
+			b.WriteString(partSign)
+			sign = partSign
+		}
+		fmt.Fprintf(&b, "%d%s", n, unit)
+	}
+	part(s.Years, "y")
+	part(s.Months, "mo")
+	part(s.Days, "d")
+	seconds := int(s.Clock / time.Second)
+	part(seconds/3600, "h")
+	part(seconds%3600/60, "m")
+	part(seconds%60, "s")
+	return b.String()
+}
+
+// TimeShift corrects the clock of a camera, identified by any of its make,
+// model and serial number. It is configured in timeShifts, which movephoto and
+// the dedupe tool share.
+type TimeShift struct {
+	Make   string `yaml:"make"` // Compared case-insensitively, empty matches any
+	Model  string `yaml:"model"`
+	Serial string `yaml:"serial"` // Serial number of the body
+	Shift  string `yaml:"shift"`  // Added to the dates of the camera clock, e.g. +1h, -30m or +1y2mo3d
+}
+
+// Matches reports whether the file with metadata meta was taken by the camera of t
+func (t TimeShift) Matches(meta Metadata) bool {
+	if meta == nil {
+		return false
+	}
+	return (t.Make == "" || strings.EqualFold(t.Make, meta.String("Make"))) &&
+		(t.Model == "" || strings.EqualFold(t.Model, meta.String("Model"))) &&
+		(t.Serial == "" || strings.EqualFold(t.Serial, CameraSerial(meta)))
+}
+
+// CameraSerial returns the serial number of the camera body
+func CameraSerial(meta Metadata) string {
+	return meta.String("SerialNumber", "BodySerialNumber", "InternalSerialNumber")
+}
+
+// CameraShift returns the correction of the first of shifts that matches the
+// camera of meta. Callers check the shifts with ParseShift beforehand.
+func CameraShift(shifts []TimeShift, meta Metadata) Shift {
+	for _, t := range shifts {
+		if t.Matches(meta) {
+			shift, _ := ParseShift(t.Shift)
+			return shift
+		}
+	}
+	return Shift{}
+}
+
+// CameraClock reports whether source reads the clock of the camera, which a
+// shift corrects. The GPS time, filenames, folders and mtime are left alone.
+func CameraClock(source string) bool {
+	switch source {
+	case Filename, FolderName, Mtime, GPS:
+		return false
+	}
+	return true
+}
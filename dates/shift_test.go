@@ -0,0 +1,115 @@
+package dates
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseShift(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Shift
+		out  string // String of the result
+	}{
+		{"+1h", Shift{Clock: time.Hour}, "+1h"},
+		{"-30m", Shift{Clock: -30 * time.Minute}, "-30m"},
+		{"90m", Shift{Clock: 90 * time.Minute}, "+1h30m"},
+		{"+1y2mo3d", Shift{Years: 1, Months: 2, Days: 3}, "+1y2mo3d"},
+		{"-1y2mo", Shift{Years: -1, Months: -2}, "-1y2mo"},
+		// A sign holds until the next one
+		{"+1d-2h30m", Shift{Days: 1, Clock: -150 * time.Minute}, "+1d-2h30m"},
+		{"-1h+30s", Shift{Clock: -time.Hour + 30*time.Second}, "-59m30s"},
+		{"+1y -6mo", Shift{Years: 1, Months: -6}, "+1y-6mo"},
+		{"+0s", Shift{}, "+0s"},
+	}
+	for _, test := range tests {
+		got, err := ParseShift(test.in)
+		if err != nil {
+			t.Errorf("ParseShift(%q): %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseShift(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+		if s := got.String(); s != test.out {
+			t.Errorf("ParseShift(%q).String() = %q, want %q", test.in, s, test.out)
+		}
+	}
+}
+
+func TestParseShiftInvalid(t *testing.T) {
+	for _, in := range []string{"", "1", "+", "1w", "+1h+", "1.5h", "h1", "+1mo-"} {
+		if shift, err := ParseShift(in); err == nil {
+			t.Errorf("ParseShift(%q) = %+v, want an error", in, shift)
+		}
+	}
+}
+
+// String writes what ParseShift reads, both ways and across the day
+func TestShiftRoundTrip(t *testing.T) {
+	shifts := []Shift{
+		{Clock: time.Hour},
+		{Clock: -time.Hour},
+		{Years: 1, Days: -1},
+		{Months: -3, Clock: 25*time.Hour + 61*time.Second},
+		{Years: -2, Months: 11, Days: -30, Clock: -(3*time.Hour + 4*time.Minute + 5*time.Second)},
+	}
+	for _, shift := range shifts {
+		for _, s := range []Shift{shift, shift.Negate()} {
+			parsed, err := ParseShift(s.String())
+			if err != nil {
+				t.Errorf("ParseShift(%q): %v", s.String(), err)
+				continue
+			}
+			if parsed != s {
+				t.Errorf("ParseShift(%q) = %+v, want %+v", s.String(), parsed, s)
+			}
+		}
+	}
+}
+
+func TestShiftApply(t *testing.T) {
+	date := time.Date(2024, time.January, 15, 23, 30, 0, 0, time.UTC)
+	shift, _ := ParseShift("+1mo1h")
+	if got, want := shift.Apply(date), time.Date(2024, time.February, 16, 0, 30, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Apply = %v, want %v", got, want)
+	}
+	if got := shift.Negate().Apply(shift.Apply(date)); !got.Equal(date) {
+		t.Errorf("Apply of the negated shift = %v, want %v", got, date)
+	}
+}
+
+// tags is metadata with a fixed set of tags
+type tags map[string]string
+
+func (m tags) String(names ...string) string {
+	for _, name := range names {
+		if value := m[name]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestCameraShift(t *testing.T) {
+	shifts := []TimeShift{
+		{Make: "canon", Serial: "123", Shift: "+1h"},
+		{Make: "Canon", Model: "Canon EOS R5", Shift: "-2h"},
+		{Model: "X-T4", Shift: "+1d"},
+	}
+	tests := []struct {
+		meta Metadata
+		want Shift
+	}{
+		{tags{"Make": "Canon", "Model": "Canon EOS R5", "SerialNumber": "123"}, Shift{Clock: time.Hour}},
+		{tags{"Make": "Canon", "Model": "Canon EOS R5", "BodySerialNumber": "456"}, Shift{Clock: -2 * time.Hour}},
+		{tags{"Make": "FUJIFILM", "Model": "x-t4"}, Shift{Days: 1}},
+		{tags{"Make": "Canon", "Model": "Canon EOS R6"}, Shift{}},
+		{nil, Shift{}},
+	}
+	for _, test := range tests {
+		if got := CameraShift(shifts, test.meta); got != test.want {
+			t.Errorf("CameraShift(%v) = %+v, want %+v", test.meta, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"movephoto/dates"
+)
+
+// DateSources is the order in which the sources of a date are tried, see the
+// dates package for the source names
+type DateSources struct {
+	Photos    []string      `yaml:"photos"`
+	Videos    []string      `yaml:"videos"`
+	Earliest  string        `yaml:"earliest"`  // YYYY-MM-DD, earlier dates are ignored as bogus
+	MaxFuture time.Duration `yaml:"maxFuture"` // Dates further ahead of now are ignored as bogus, 0 means no limit
+}
+
+// window returns the range of believable dates. An invalid earliest was
+// already rejected by checkConfig.
+func (d DateSources) window() dates.Window {
+	window := dates.Window{MaxFuture: d.MaxFuture}
+	if d.Earliest != "" {
+		window.Earliest, _ = time.Parse(ruleDateLayout, d.Earliest)
+	}
+	return window
+}
+
+// dateTaken dates a file by the first of sources that has a believable date,
+// with the camera clock corrected by shift, returning the date and its source
+func dateTaken(settings watchSettings, sources []string, meta mediaMetadata, shift dates.Shift, filePath string, file os.FileInfo) (time.Time, string, error) {
+	return dates.Find(sources, settings.DateWindow, dates.File{Path: filePath, ModTime: file.ModTime(), Meta: meta, Shift: shift})
+}
+
+// dateFile dates a file by sources, corrected by the time shift of its camera,
+// and then by the unknownDate fallbacks. It returns the date, its source and
+// the time shift that was applied, if any.
+func dateFile(settings watchSettings, sources []string, meta mediaMetadata, filePath string, file os.FileInfo) (time.Time, string, string, error) {
+	shift := dates.CameraShift(settings.TimeShifts, meta)
+	date, source, err := dateTaken(settings, sources, meta, shift, filePath, file)
+	if err == nil {
+		if !dates.CameraClock(source) || shift.IsZero() {
+			return date, source, "", nil
+		}
+		slog.Debug("Shifted camera clock", "source", filePath, "shift", shift.String(), "date", date)
+		return date, source, shift.String(), nil
+	}
+	if len(settings.UnknownDate.Fallbacks) > 0 {
+		date, source, err = fallbackDate(settings, settings.UnknownDate, filePath, file)
+	}
+	return date, source, "", err
+}
+
+// checkDateSources validates the dateSources of config
+func checkDateSources(config Config, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	add := func(line int, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	for _, media := range []struct {
+		key     string
+		sources []string
+	}{{"photos", config.DateSources.Photos}, {"videos", config.DateSources.Videos}} {
+		if len(media.sources) == 0 {
+			add(lineOf(root, "dateSources"), "dateSources.%s is empty, no %s could be dated", media.key, media.key)
+		}
+		for i, source := range media.sources {
+			if err := dates.CheckSource(source); err != nil {
+				add(lineOf(root, "dateSources", media.key, i), "%v", err)
+			}
+		}
+	}
+	if _, err := time.Parse(ruleDateLayout, config.DateSources.Earliest); config.DateSources.Earliest != "" && err != nil {
+		add(lineOf(root, "dateSources", "earliest"), "invalid dateSources.earliest %q, expected YYYY-MM-DD", config.DateSources.Earliest)
+	}
+	if config.DateSources.MaxFuture < 0 {
+		add(lineOf(root, "dateSources", "maxFuture"), "dateSources.maxFuture must not be negative")
+	}
+	return problems
+}
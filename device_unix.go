@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// sameDevice reports whether both paths live on the same filesystem, so that a
+// rename between them is possible
+func sameDevice(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	aStat, ok := aInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	bStat, ok := bInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return aStat.Dev == bStat.Dev
+}
+
+// deviceKey identifies the filesystem holding path
+func deviceKey(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return path
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return path
+	}
+	return strconv.FormatUint(uint64(stat.Dev), 10)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sameDevice reports whether both paths are on the same volume, so that a
+// rename between them is possible
+func sameDevice(a, b string) bool {
+	aAbs, err := filepath.Abs(a)
+	if err != nil {
+		return false
+	}
+	bAbs, err := filepath.Abs(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(filepath.VolumeName(aAbs), filepath.VolumeName(bAbs))
+}
+
+// deviceKey identifies the volume holding path
+func deviceKey(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return strings.ToUpper(filepath.VolumeName(abs))
+}
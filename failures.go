@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"movephoto/logging"
+)
+
+// FailurePolicy decides how often a file that failed is tried again
+type FailurePolicy struct {
+	MaxAttempts       int           `yaml:"maxAttempts"`       // Attempts before giving up, 0 retries forever
+	Backoff           time.Duration `yaml:"backoff"`           // Delay before the second attempt, doubling after every further failure
+	MaxBackoff        time.Duration `yaml:"maxBackoff"`        // Longest delay between attempts
+	NeedsAttentionDir string        `yaml:"needsAttentionDir"` // Where move watch directories put files after the last attempt, empty leaves them in place
+}
+
+// failureRecord tracks the failed attempts to import one file
+type failureRecord struct {
+	Source      string    `json:"source"`
+	Size        int64     `json:"size"`    // Of the file that failed, a changed file starts over
+	ModTime     time.Time `json:"modTime"` // Of the file that failed
+	Reason      string    `json:"reason"`  // "no valid date found", or the action of a failed transfer
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	FirstFailed time.Time `json:"firstFailed"`
+	LastFailed  time.Time `json:"lastFailed"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	GaveUp      bool      `json:"gaveUp,omitempty"`  // No more attempts, the file needs attention
+	MovedTo     string    `json:"movedTo,omitempty"` // Where the file was moved after giving up
+}
+
+// failureDB is the list of files that failed to import, kept as
+// movephoto_failures.json next to the state database
+type failureDB struct {
+	mu      sync.Mutex
+	path    string
+	policy  FailurePolicy
+	records map[string]failureRecord // Keyed by source path
+}
+
+// Global failure list
+var failures = &failureDB{records: make(map[string]failureRecord)}
+
+// open switches to the failure list at path, starting an empty one if it doesn't exist yet
+func (db *failureDB) open(path string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.path = path
+	db.records = make(map[string]failureRecord)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read failure list", "path", path, logging.Err(err))
+		}
+		return
+	}
+	var records []failureRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		// Losing the attempt counts only means the files are tried again
+		slog.Warn("Ignoring unreadable failure list", "path", path, logging.Err(err))
+		return
+	}
+	for _, record := range records {
+		db.records[record.Source] = record
+	}
+}
+
+// startScan sets the retry policy for the scan and forgets files that have
+// disappeared from the watch directories without being moved aside
+func (db *failureDB) startScan(policy FailurePolicy) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.policy = policy
+
+	changed := false
+	for source, record := range db.records {
+		if record.MovedTo != "" {
+			continue
+		}
+		if _, err := os.Lstat(source); os.IsNotExist(err) {
+			delete(db.records, source)
+			changed = true
+		}
+	}
+	if changed {
+		db.save()
+	}
+}
+
+// check returns why c shouldn't be tried in this scan, or an empty reason.
+// Failures of a file that has changed since are forgotten.
+func (db *failureDB) check(c *candidate) (string, string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	record, ok := db.records[c.path]
+	if !ok {
+		return "", ""
+	}
+	// A file that changed starts over, and so does one moved back from the
+	// needs attention folder, which a rename leaves unchanged
+	if record.Size != c.info.Size() || !record.ModTime.Equal(c.info.ModTime()) || record.MovedTo != "" {
+		delete(db.records, c.path)
+		db.save()
+		return "", ""
+	}
+	if record.GaveUp {
+		return "needs attention", fmt.Sprintf("%d attempts, last error: %s", record.Attempts, record.Error)
+	}
+	if time.Now().Before(record.NextAttempt) {
+		return "waiting to retry", fmt.Sprintf("attempt %d at %s", record.Attempts+1, record.NextAttempt.Format(time.RFC3339))
+	}
+	return "", ""
+}
+
+// record counts a failed attempt to import source and works out when to try
+// again. It reports whether that was the last attempt.
+func (db *failureDB) record(source, reason, message string) (failureRecord, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	record, ok := db.records[source]
+	info, err := os.Stat(source)
+	if err == nil && ok && (record.Size != info.Size() || !record.ModTime.Equal(info.ModTime())) {
+		ok = false // A different file than the one that failed before
+	}
+	if !ok {
+		record = failureRecord{Source: source, FirstFailed: now}
+	}
+	if err == nil {
+		record.Size, record.ModTime = info.Size(), info.ModTime()
+	}
+	record.Reason, record.Error = reason, message
+	record.Attempts++
+	record.LastFailed = now
+	record.NextAttempt = now.Add(db.backoff(record.Attempts))
+	record.GaveUp = db.policy.MaxAttempts > 0 && record.Attempts >= db.policy.MaxAttempts
+	db.records[source] = record
+	db.save()
+	return record, record.GaveUp
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (db *failureDB) backoff(attempts int) time.Duration {
+	delay := db.policy.Backoff
+	for i := 1; i < attempts && (db.policy.MaxBackoff <= 0 || delay < db.policy.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if db.policy.MaxBackoff > 0 && delay > db.policy.MaxBackoff {
+		delay = db.policy.MaxBackoff
+	}
+	return delay
+}
+
+// setMovedTo records where a file that needs attention was moved
+func (db *failureDB) setMovedTo(source, movedTo string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if record, ok := db.records[source]; ok {
+		record.MovedTo = movedTo
+		db.records[source] = record
+		db.save()
+	}
+}
+
+// forget drops the failures of source, reporting whether there were any
+func (db *failureDB) forget(source string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.records[source]; !ok {
+		return false
+	}
+	delete(db.records, source)
+	db.save()
+	return true
+}
+
+// retry forgets the failures of source so that it is tried again. A file
+// moved to the needs attention folder is only forgotten once it is back in
+// place; until then the record is returned with moved set.
+func (db *failureDB) retry(source string) (record failureRecord, found, moved bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	record, found = db.records[source]
+	if !found {
+		return record, false, false
+	}
+	if record.MovedTo != "" {
+		if _, err := os.Lstat(source); err != nil {
+			return record, true, true
+		}
+	}
+	delete(db.records, source)
+	db.save()
+	return record, true, false
+}
+
+// list returns the failures, most recent first
+func (db *failureDB) list() []failureRecord {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	records := make([]failureRecord, 0, len(db.records))
+	for _, record := range db.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].LastFailed.After(records[j].LastFailed) })
+	return records
+}
+
+// save writes the failure list to disk, replacing the old one atomically. The
+// caller holds db.mu.
+func (db *failureDB) save() {
+	if db.path == "" {
+		return
+	}
+	records := make([]failureRecord, 0, len(db.records))
+	for _, record := range db.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Source < records[j].Source })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode failure list", logging.Err(err))
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(db.path), os.ModePerm); err != nil {
+		slog.Error("Failed to create failure list directory", "path", db.path, logging.Err(err))
+		return
+	}
+	tmp := db.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		slog.Error("Failed to write failure list", "path", db.path, logging.Err(err))
+		return
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		slog.Error("Failed to write failure list", "path", db.path, logging.Err(err))
+	}
+}
+
+// trackFailure records a failed attempt to import source. After the last
+// attempt files of move watch directories are moved to needsAttentionDir,
+// if set; other files stay where they are and are no longer tried.
+func trackFailure(source, reason, message string, moveMode bool) {
+	record, gaveUp := failures.record(source, reason, message)
+	if !gaveUp {
+		slog.Debug("Will retry file", "source", source, "attempts", record.Attempts, "next", record.NextAttempt)
+		return
+	}
+
+	failures.mu.Lock()
+	dir := failures.policy.NeedsAttentionDir
+	failures.mu.Unlock()
+	if !moveMode || dir == "" {
+		slog.Warn("File needs attention, giving up", "source", source, "attempts", record.Attempts, "reason", reason, "error", message)
+		return
+	}
+
+	destination, err := moveToNeedsAttention(source, dir)
+	if err != nil {
+		slog.Error("Failed to move file to the needs attention folder, leaving it in place", "source", source, "dir", dir, logging.Err(err))
+		return
+	}
+	failures.setMovedTo(source, destination)
+	record.MovedTo = destination
+	appendNeedsAttentionReport(dir, record)
+	slog.Warn("File needs attention, moved it aside", "source", source, "destination", destination, "attempts", record.Attempts, "reason", reason, "error", message)
+}
+
+// moveToNeedsAttention renames source into dir without replacing a file that
+// is already there, returning the new path
+func moveToNeedsAttention(source, dir string) (string, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	name := filepath.Base(source)
+	ext := filepath.Ext(name)
+	destination := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(destination); os.IsNotExist(err) {
+			break
+		}
+		destination = filepath.Join(dir, fmt.Sprintf("%s_%d%s", name[:len(name)-len(ext)], i, ext))
+	}
+	return destination, os.Rename(source, destination)
+}
+
+// appendNeedsAttentionReport adds record to needs_attention.jsonl in dir, so
+// the folder explains why each file is in it
+func appendNeedsAttentionReport(dir string, record failureRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(dir, "needs_attention.jsonl")
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("Failed to write needs attention report", "path", path, logging.Err(err))
+		return
+	}
+	defer file.Close()
+	file.Write(append(line, '\n'))
+}
+
+// runFailuresCommand prints the files that failed to import, or with retry
+// forgets the failures of the given files, and returns the exit code
+func runFailuresCommand(args []string) int {
+	if len(args) > 0 && (args[0] != "retry" || len(args) == 1) {
+		fmt.Fprintln(os.Stderr, "usage: movephoto [flags] failures [retry FILE...]")
+		return 2
+	}
+	config, err := readConfig(*configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	db := &failureDB{}
+	db.open(filepath.Join(config.DefaultDestinationDir, "movephoto_failures.json"))
+	if len(args) > 0 {
+		return retryFailures(config, db, args[1:])
+	}
+
+	records := db.list()
+	if len(records) == 0 {
+		fmt.Println("No failed files")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tATTEMPTS\tSTATUS\tREASON\tERROR")
+	for _, record := range records {
+		state := "retry at " + record.NextAttempt.Format("2006-01-02 15:04")
+		switch {
+		case record.MovedTo != "":
+			state = "moved to " + record.MovedTo
+		case record.GaveUp:
+			state = "needs attention"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", record.Source, record.Attempts, state, record.Reason, record.Error)
+	}
+	w.Flush()
+	return 0
+}
+
+// retryFailures forgets the failures of paths so that the next scan tries
+// them straight away. A running instance keeps its own copy of the failure
+// list, so this needs the instance lock and points at the API otherwise.
+func retryFailures(config Config, db *failureDB, paths []string) int {
+	if config.LockFilePath != "" {
+		lock, err := acquireLock(config.LockFilePath, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v; retry files of a running instance with POST /retry of its API\n", err)
+			return 1
+		}
+		defer lock.release()
+	}
+
+	code := 0
+	for _, path := range paths {
+		record, found, moved := db.retry(path)
+		switch {
+		case !found:
+			fmt.Fprintf(os.Stderr, "no failed file %q\n", path)
+			code = 1
+		case moved:
+			fmt.Fprintf(os.Stderr, "%q was moved to %q, move it back to retry it\n", path, record.MovedTo)
+			code = 1
+		default:
+			fmt.Printf("Forgot the failures of %s, the next scan tries it again\n", path)
+		}
+	}
+	return code
+}
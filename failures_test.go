@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A file moved back from the needs attention folder has the size and mtime it
+// failed with, yet is tried again
+func TestCheckMovedBack(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "photo.jpg")
+	if err := os.WriteFile(source, []byte("photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaveUp := failureRecord{Source: source, Size: info.Size(), ModTime: info.ModTime(), Attempts: 5, GaveUp: true}
+	moved := gaveUp
+	moved.MovedTo = filepath.Join(dir, "attention", "photo.jpg")
+
+	for name, record := range map[string]failureRecord{"in place": gaveUp, "moved back": moved} {
+		db := &failureDB{records: map[string]failureRecord{source: record}}
+		reason, _ := db.check(&candidate{path: source, info: info})
+		want := ""
+		if record.MovedTo == "" {
+			want = "needs attention"
+		}
+		if reason != want {
+			t.Errorf("%s: check = %q, want %q", name, reason, want)
+		}
+	}
+}
+
+func TestRetryFailures(t *testing.T) {
+	dir := t.TempDir()
+	db := &failureDB{path: filepath.Join(dir, "movephoto_failures.json"), records: map[string]failureRecord{
+		"/watch/a.jpg": {Source: "/watch/a.jpg", GaveUp: true},
+		"/watch/b.jpg": {Source: "/watch/b.jpg", GaveUp: true, MovedTo: filepath.Join(dir, "b.jpg")},
+	}}
+	config := Config{LockFilePath: filepath.Join(dir, "movephoto.lock")}
+	if code := retryFailures(config, db, []string{"/watch/a.jpg"}); code != 0 {
+		t.Errorf("retry of a failed file: exit code %d", code)
+	}
+	if code := retryFailures(config, db, []string{"/watch/b.jpg", "/watch/c.jpg"}); code != 1 {
+		t.Errorf("retry of a moved and an unknown file: exit code %d, want 1", code)
+	}
+
+	reopened := &failureDB{}
+	reopened.open(db.path)
+	if records := reopened.list(); len(records) != 1 || records[0].Source != "/watch/b.jpg" {
+		t.Errorf("failure list after retry = %+v, want only the moved file", records)
+	}
+}
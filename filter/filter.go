@@ -0,0 +1,115 @@
+// Package filter decides which files in a directory are handled, using include
+// and exclude patterns shared by movephoto and the dedupe tool.
+package filter
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a pattern as a regular expression instead of a glob
+const regexPrefix = "re:"
+
+// pattern is one compiled include or exclude pattern
+type pattern struct {
+	source string
+	glob   string         // Lowercased glob, empty for regexes
+	regex  *regexp.Regexp // Nil for globs
+}
+
+// Filter holds compiled include and exclude patterns. A nil Filter lets every file through.
+type Filter struct {
+	include []pattern
+	exclude []pattern
+}
+
+// New compiles include and exclude patterns. Patterns starting with "re:" are
+// regular expressions, everything else is a case-insensitive glob.
+func New(include, exclude []string) (*Filter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &Filter{}
+	var err error
+	if f.include, err = compile(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compile(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// compile compiles a list of patterns
+func compile(sources []string) ([]pattern, error) {
+	patterns := make([]pattern, 0, len(sources))
+	for _, source := range sources {
+		p := pattern{source: source}
+		if strings.HasPrefix(source, regexPrefix) {
+			re, err := regexp.Compile(strings.TrimPrefix(source, regexPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", source, err)
+			}
+			p.regex = re
+		} else {
+			p.glob = strings.ToLower(source)
+			if _, err := path.Match(p.glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", source, err)
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// PrefixPatterns turns literal filename prefixes into the equivalent globs
+func PrefixPatterns(prefixes []string) []string {
+	patterns := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		escaped := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(prefix)
+		patterns = append(patterns, escaped+"*")
+	}
+	return patterns
+}
+
+// matches reports whether p matches the filename or the relative path
+func (p pattern) matches(name, relPath string) bool {
+	for _, s := range []string{name, relPath} {
+		if p.regex != nil {
+			if p.regex.MatchString(s) {
+				return true
+			}
+		} else if ok, _ := path.Match(p.glob, strings.ToLower(s)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the file at relPath, relative to the scanned directory,
+// should be handled. When it shouldn't, reason names the pattern that filtered it.
+// Exclude patterns win over include patterns.
+func (f *Filter) Match(relPath string) (ok bool, reason string) {
+	if f == nil {
+		return true, ""
+	}
+	relPath = filepath.ToSlash(relPath)
+	name := path.Base(relPath)
+	for _, p := range f.exclude {
+		if p.matches(name, relPath) {
+			return false, fmt.Sprintf("excluded by %q", p.source)
+		}
+	}
+	if len(f.include) == 0 {
+		return true, ""
+	}
+	for _, p := range f.include {
+		if p.matches(name, relPath) {
+			return true, ""
+		}
+	}
+	return false, "not matched by any include pattern"
+}
@@ -0,0 +1,87 @@
+package filter
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	f, err := New(
+		[]string{"*.jpg", "IMG_*", `re:^DCIM/\d+`},
+		[]string{"*.tmp", "re:(^|/)\\.", "trash/*"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		ok     bool
+		reason string
+	}{
+		{"photo.jpg", true, ""},
+		{"PHOTO.JPG", true, ""},           // Globs ignore case
+		{"2024/photo.jpg", true, ""},      // Matched by the filename
+		{"IMG_0001.HEIC", true, ""},       // Any include pattern will do
+		{"DCIM/100CANON/x.cr3", true, ""}, // Matched by the relative path
+		{"video.mp4", false, "not matched by any include pattern"},
+		{"dcim/100/x.cr3", false, "not matched by any include pattern"}, // Regexes keep case
+		{"IMG_0001.jpg.tmp", false, `excluded by "*.tmp"`},
+		{".hidden.jpg", false, `excluded by "re:(^|/)\\."`},
+		{"trash/photo.jpg", false, `excluded by "trash/*"`}, // Excludes win
+	}
+	for _, test := range tests {
+		ok, reason := f.Match(test.path)
+		if ok != test.ok || reason != test.reason {
+			t.Errorf("Match(%q) = %v, %q, want %v, %q", test.path, ok, reason, test.ok, test.reason)
+		}
+	}
+}
+
+func TestMatchExcludeOnly(t *testing.T) {
+	f, err := New(nil, []string{"*.xmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := f.Match("photo.jpg"); !ok {
+		t.Error("an exclude pattern alone filtered a file it doesn't match")
+	}
+	if ok, _ := f.Match("photo.xmp"); ok {
+		t.Error("photo.xmp passed *.xmp")
+	}
+}
+
+func TestNoPatterns(t *testing.T) {
+	f, err := New(nil, nil)
+	if err != nil || f != nil {
+		t.Fatalf("New(nil, nil) = %v, %v, want a nil filter", f, err)
+	}
+	if ok, reason := f.Match("anything"); !ok || reason != "" {
+		t.Errorf("nil filter: Match = %v, %q", ok, reason)
+	}
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"[a-", "re:("} {
+		if _, err := New([]string{pattern}, nil); err == nil {
+			t.Errorf("New accepted the include pattern %q", pattern)
+		}
+		if _, err := New(nil, []string{pattern}); err == nil {
+			t.Errorf("New accepted the exclude pattern %q", pattern)
+		}
+	}
+}
+
+func TestPrefixPatterns(t *testing.T) {
+	f, err := New(PrefixPatterns([]string{"IMG_", "[1]*"}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{
+		"IMG_0001.jpg": true,
+		"img_0001.jpg": true,
+		"[1]*copy.jpg": true,
+		"1x.jpg":       false, // The prefix is literal, not a glob
+		"DSC_0001.jpg": false,
+	} {
+		if ok, _ := f.Match(path); ok != want {
+			t.Errorf("Match(%q) = %v, want %v", path, ok, want)
+		}
+	}
+}
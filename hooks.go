@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"movephoto/logging"
+	"movephoto/report"
+)
+
+// Events hooks can subscribe to
+const (
+	eventPreImport    = "preImport"    // Before a file is transferred, a failing hook keeps it in place
+	eventPostImport   = "postImport"   // After a file was imported
+	eventError        = "error"        // After the transfer of a file failed
+	eventScanComplete = "scanComplete" // After a scan that imported something or failed
+)
+
+// defaultHookTimeout limits one attempt of a hook when the config doesn't
+const defaultHookTimeout = 30 * time.Second
+
+// hookQueueSize bounds the postImport and error events waiting for delivery.
+// Transfers wait for room once hooks fall that far behind.
+const hookQueueSize = 1000
+
+// Hook runs a command or calls a webhook when import events happen
+type Hook struct {
+	Name    string            `yaml:"name"`
+	Events  []string          `yaml:"events"`  // preImport, postImport, error and/or scanComplete
+	Command []string          `yaml:"command"` // Program and arguments, gets the event as JSON on stdin
+	URL     string            `yaml:"url"`     // Webhook the event is POSTed to as JSON
+	Headers map[string]string `yaml:"headers"` // Extra HTTP headers for the webhook
+	Timeout time.Duration     `yaml:"timeout"` // Per attempt, defaults to 30s
+	Retries int               `yaml:"retries"` // Further attempts after a failure, with doubling delays from 1s
+	Batch   bool              `yaml:"batch"`   // Deliver the postImport and error events of a scan together when it ends
+}
+
+// hookFile describes the file an event is about
+type hookFile struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination,omitempty"`
+	Size        int64    `json:"size,omitempty"`
+	Action      string   `json:"action,omitempty"`
+	Checksum    string   `json:"checksum,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Rule        string   `json:"rule,omitempty"`
+	DateSource  string   `json:"dateSource,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// hookEvent is the JSON a hook receives
+type hookEvent struct {
+	Event   string         `json:"event"`
+	Time    time.Time      `json:"time"`
+	Files   []hookFile     `json:"files,omitempty"`
+	Summary *report.Report `json:"summary,omitempty"` // scanComplete only
+}
+
+// batchKey identifies the batched events of one hook
+type batchKey struct {
+	hook  int
+	event string
+}
+
+// hookDelivery is an event waiting in the queue for hook i
+type hookDelivery struct {
+	hook  Hook
+	i     int
+	event hookEvent
+}
+
+// hookRunner fires the hooks of the current scan. Events about single files
+// are delivered in order by one goroutine, so that slow hooks don't hold up
+// the transfers.
+type hookRunner struct {
+	mu      sync.Mutex
+	hooks   []Hook
+	batches map[batchKey][]hookFile
+
+	start   sync.Once
+	queue   chan hookDelivery
+	pending sync.WaitGroup // Events in the queue or being delivered
+}
+
+// Global hooks of the current scan
+var hooks = &hookRunner{queue: make(chan hookDelivery, hookQueueSize)}
+
+// reset starts a scan with the hooks of the config
+func (h *hookRunner) reset(list []Hook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = list
+	h.batches = make(map[batchKey][]hookFile)
+}
+
+// subscribed returns the indexes of the hooks listening to event
+func (h *hookRunner) subscribed(event string) []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var indexes []int
+	for i, hook := range h.hooks {
+		for _, e := range hook.Events {
+			if e == event {
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// hook returns hook i of the current scan
+func (h *hookRunner) hook(i int) Hook {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hooks[i]
+}
+
+// preImport runs the preImport hooks for c one after the other. It returns an
+// error naming the first hook that failed, in which case c is not imported.
+func (h *hookRunner) preImport(c *candidate) error {
+	event := hookEvent{Event: eventPreImport, Time: time.Now(), Files: []hookFile{{
+		Source:      c.path,
+		Destination: c.fullDestination,
+		Size:        c.info.Size(),
+		Tags:        c.route.tags,
+		Rule:        c.route.rule,
+		DateSource:  c.route.dateSource,
+	}}}
+	for _, i := range h.subscribed(eventPreImport) {
+		hook := h.hook(i)
+		if err := deliverHook(hook, event); err != nil {
+			return fmt.Errorf("%s: %v", hookName(hook, i), err)
+		}
+	}
+	return nil
+}
+
+// fileEvent queues event about file for the hooks listening to it, or adds it
+// to their batch
+func (h *hookRunner) fileEvent(event string, file hookFile) {
+	for _, i := range h.subscribed(event) {
+		hook := h.hook(i)
+		if hook.Batch {
+			h.mu.Lock()
+			key := batchKey{hook: i, event: event}
+			h.batches[key] = append(h.batches[key], file)
+			h.mu.Unlock()
+			continue
+		}
+		h.start.Do(func() { go h.deliverQueue() })
+		h.pending.Add(1)
+		h.queue <- hookDelivery{hook: hook, i: i, event: hookEvent{Event: event, Time: time.Now(), Files: []hookFile{file}}}
+	}
+}
+
+// deliverQueue delivers the queued events one after the other
+func (h *hookRunner) deliverQueue() {
+	for d := range h.queue {
+		if err := deliverHook(d.hook, d.event); err != nil {
+			slog.Error("Hook failed", "hook", hookName(d.hook, d.i), "event", d.event.Event, "source", d.event.Files[0].Source, logging.Err(err))
+		}
+		h.pending.Done()
+	}
+}
+
+// finishScan waits for the queued events of the scan and delivers its batched
+// events and, if it was eventful, the scanComplete event with the summary
+func (h *hookRunner) finishScan(eventful bool) {
+	h.pending.Wait()
+
+	h.mu.Lock()
+	list, batches := h.hooks, h.batches
+	h.batches = make(map[batchKey][]hookFile)
+	h.mu.Unlock()
+
+	for i, hook := range list {
+		for _, event := range hook.Events {
+			files := batches[batchKey{hook: i, event: event}]
+			if len(files) == 0 {
+				continue
+			}
+			if err := deliverHook(hook, hookEvent{Event: event, Time: time.Now(), Files: files}); err != nil {
+				slog.Error("Hook failed", "hook", hookName(hook, i), "event", event, "files", len(files), logging.Err(err))
+			}
+		}
+	}
+
+	if !eventful {
+		return
+	}
+	for _, i := range h.subscribed(eventScanComplete) {
+		hook := list[i]
+		if err := deliverHook(hook, hookEvent{Event: eventScanComplete, Time: time.Now(), Summary: summary}); err != nil {
+			slog.Error("Hook failed", "hook", hookName(hook, i), "event", eventScanComplete, logging.Err(err))
+		}
+	}
+}
+
+// hookName returns a name for hook i to use in logs
+func hookName(hook Hook, i int) string {
+	if hook.Name != "" {
+		return hook.Name
+	}
+	return fmt.Sprintf("hook %d", i+1)
+}
+
+// deliverHook runs hook for event, retrying with doubling delays until it
+// succeeds or runs out of retries
+func deliverHook(hook Hook, event hookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if hook.URL != "" {
+			err = postHook(ctx, hook, payload)
+		} else {
+			err = runHookCommand(ctx, hook, event, payload)
+		}
+		cancel()
+		if err == nil || attempt >= hook.Retries {
+			return err
+		}
+		slog.Debug("Retrying hook", "hook", hook.Name, "event", event.Event, "attempt", attempt+1, "delay", delay, logging.Err(err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postHook POSTs payload to the webhook of hook. Responses other than 2xx are errors.
+func postHook(ctx context.Context, hook Hook, payload []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range hook.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// hookEnvPrefix starts the environment variables describing an event
+const hookEnvPrefix = envPrefix + "HOOK_"
+
+// runHookCommand runs the command of hook with payload on stdin and the event
+// details in MOVEPHOTO_HOOK_* environment variables. The config overrides in
+// the environment of movephoto are left out, so that they don't apply to a
+// movephoto the hook runs.
+func runHookCommand(ctx context.Context, hook Hook, event hookEvent, payload []byte) error {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	for _, entry := range os.Environ() {
+		if !strings.HasPrefix(entry, envPrefix) {
+			cmd.Env = append(cmd.Env, entry)
+		}
+	}
+	cmd.Env = append(cmd.Env, hookEnv(event)...)
+	cmd.WaitDelay = time.Second // Don't wait for children that keep the output open
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			const maxOutput = 500
+			if len(text) > maxOutput {
+				text = text[:maxOutput] + "..."
+			}
+			return fmt.Errorf("%v: %s", err, text)
+		}
+		return err
+	}
+	return nil
+}
+
+// hookEnv returns the environment variables describing event. The file
+// details are only set for events about a single file.
+func hookEnv(event hookEvent) []string {
+	env := []string{
+		hookEnvPrefix + "EVENT=" + event.Event,
+		hookEnvPrefix + "FILES=" + strconv.Itoa(len(event.Files)),
+	}
+	if len(event.Files) == 1 {
+		f := event.Files[0]
+		env = append(env,
+			hookEnvPrefix+"SOURCE="+f.Source,
+			hookEnvPrefix+"DESTINATION="+f.Destination,
+			hookEnvPrefix+"SIZE="+strconv.FormatInt(f.Size, 10),
+			hookEnvPrefix+"ACTION="+f.Action,
+			hookEnvPrefix+"CHECKSUM="+f.Checksum,
+			hookEnvPrefix+"TAGS="+strings.Join(f.Tags, ","),
+			hookEnvPrefix+"RULE="+f.Rule,
+			hookEnvPrefix+"DATE_SOURCE="+f.DateSource,
+			hookEnvPrefix+"ERROR="+f.Error,
+		)
+	}
+	if event.Summary != nil {
+		env = append(env, hookEnvPrefix+"SUMMARY="+event.Summary.String())
+	}
+	return env
+}
+
+// checkHooks validates the hooks of config
+func checkHooks(config Config, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	add := func(line int, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	for i, hook := range config.Hooks {
+		name := hookName(hook, i)
+		if len(hook.Events) == 0 {
+			add(lineOf(root, "hooks", i), "%s has no events", name)
+		}
+		for j, event := range hook.Events {
+			switch event {
+			case eventPreImport:
+				if hook.Batch {
+					add(lineOf(root, "hooks", i, "events", j), "%s can't batch preImport events, they are needed before each file", name)
+				}
+			case eventPostImport, eventError, eventScanComplete:
+			default:
+				add(lineOf(root, "hooks", i, "events", j), "unknown event %q in %s, expected preImport, postImport, error or scanComplete", event, name)
+			}
+		}
+		switch {
+		case len(hook.Command) > 0 && hook.URL != "":
+			add(lineOf(root, "hooks", i), "%s has both a command and a url", name)
+		case len(hook.Command) == 0 && hook.URL == "":
+			add(lineOf(root, "hooks", i), "%s needs a command or a url", name)
+		case hook.URL != "":
+			if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add(lineOf(root, "hooks", i, "url"), "invalid url %q in %s, expected an http or https URL", hook.URL, name)
+			}
+		case hook.Command[0] == "":
+			add(lineOf(root, "hooks", i, "command"), "%s has an empty command", name)
+		}
+		if hook.Timeout < 0 {
+			add(lineOf(root, "hooks", i, "timeout"), "timeout of %s must not be negative", name)
+		}
+		if hook.Retries < 0 {
+			add(lineOf(root, "hooks", i, "retries"), "retries of %s must not be negative", name)
+		}
+	}
+	return problems
+}
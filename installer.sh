@@ -10,7 +10,7 @@ Description=Movephoto Service
 After=network.target
 
 [Service]
-ExecStart=/usr/local/bin/movephoto --watch --config /etc/movephoto_config.yaml
+ExecStart=/usr/local/bin/movephoto --watch --config /etc/movephoto_config.yaml --log-format journal
 Restart=always
 RestartSec=5
 SyslogIdentifier=movephoto
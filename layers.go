@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variables that override config fields
+const envPrefix = "MOVEPHOTO_"
+
+// defaultConfigYAML is the lowest config layer. Settings without a default here
+// are either required or computed at run time, such as workers.
+const defaultConfigYAML = `destinationTemplate: "` + defaultDestinationTemplate + `"
+minFileSize: 102400
+maxFileSize: 0
+verify: hash
+checksum: sha256
+moveStrategy: auto
+deviceWorkers: 2
+rawExtensions: [.cr2, .cr3, .nef, .arw, .raf, .orf, .rw2, .dng]
+metadataBackend: auto
+dateSources:
+  photos: [DateTimeOriginal, CreateDate, ModifyDate, DateTimeDigitized, filename]
+  videos: [MediaCreateDate, CreateDate, ModifyDate]
+  earliest: "1980-01-01"
+  maxFuture: 24h
+failures:
+  maxAttempts: 5
+  backoff: 1m
+  maxBackoff: 6h
+`
+
+var (
+	configDir   = flag.String("config-dir", "", "Directory of extra config files merged over -config (defaults to the -config path with a .d extension)")
+	setSettings settingList
+)
+
+func init() {
+	flag.Var(&setSettings, "set", "Override a config field, e.g. -set preserve.mtime=true (repeatable)")
+}
+
+// settingList collects repeated -set flags
+type settingList []string
+
+func (s *settingList) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *settingList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// configLayer is one source of config values. Later layers override earlier
+// ones field by field; lists are replaced as a whole.
+type configLayer struct {
+	name  string     // File path, environment variable or flag the values came from
+	file  bool       // Whether name is a file, so that line numbers mean something
+	root  *yaml.Node // Document node
+	first int        // Global line number of the first line of the layer
+}
+
+// configLayers collects every layer of the config in order of precedence:
+// built-in defaults, the file at path, the files in the config directory,
+// MOVEPHOTO_* environment variables and -set flags. Problems are returned for
+// layers that can't be parsed at all; those layers are left out.
+func configLayers(path string) ([]configLayer, []configProblem, error) {
+	var layers []configLayer
+	var problems []configProblem
+	next := 1
+	add := func(name string, file bool, root *yaml.Node) {
+		lines := shiftLines(root, next-1)
+		layers = append(layers, configLayer{name: name, file: file, root: root, first: next})
+		next += lines
+	}
+	addYAML := func(name string, data []byte) {
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			for _, problem := range yamlProblems(err) {
+				problem.File = name
+				problems = append(problems, problem)
+			}
+			return
+		}
+		if len(root.Content) == 0 {
+			return // Empty file
+		}
+		add(name, true, &root)
+	}
+
+	addYAML("default", []byte(defaultConfigYAML))
+	layers[0].file = false
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			problems = append(problems, configProblem{File: path, Message: "config file is empty"})
+		}
+		addYAML(path, data)
+	}
+
+	files, err := configDirFiles(configDirPath(path))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		addYAML(file, data)
+	}
+
+	keys := configKeys()
+	env := os.Environ()
+	sort.Strings(env)
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(name, envPrefix) || strings.HasPrefix(name, hookEnvPrefix) {
+			continue // Hook variables are set for the hooks, a hook may run movephoto
+		}
+		key, ok := keys[strings.TrimPrefix(name, envPrefix)]
+		if !ok {
+			problems = append(problems, configProblem{File: name, Message: "unknown environment variable, no config field matches it", Warning: true})
+			continue
+		}
+		add(name, false, settingNode(key.path, value, key.fieldType))
+	}
+
+	for _, setting := range setSettings {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			problems = append(problems, configProblem{File: "-set " + setting, Message: "expected -set key=value"})
+			continue
+		}
+		path := strings.Split(key, ".")
+		add("-set "+key, false, settingNode(path, value, fieldType(reflect.TypeOf(Config{}), path)))
+	}
+	return layers, problems, nil
+}
+
+// configDirPath returns the directory of extra config files for the config file at path
+func configDirPath(path string) string {
+	if *configDir != "" || path == "" {
+		return *configDir
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+}
+
+// configDirFiles lists the YAML files in dir in lexical order. A missing directory has no files.
+func configDirFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.Type().IsRegular() && (ext == ".yml" || ext == ".yaml") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// shiftLines moves every node below root down by offset lines, so that line
+// numbers stay unique once the layers are merged, and returns the number of
+// lines the layer spans
+func shiftLines(root *yaml.Node, offset int) int {
+	last := 1
+	var walk func(node *yaml.Node)
+	walk = func(node *yaml.Node) {
+		if node.Line > last {
+			last = node.Line
+		}
+		node.Line += offset
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+	walk(root)
+	return last
+}
+
+// mergeLayers merges the layers into a single document. The layers share nodes
+// with the result and can't be merged again.
+func mergeLayers(layers []configLayer) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	for _, layer := range layers {
+		mergeNode(merged.Content[0], layer.root.Content[0])
+	}
+	return merged
+}
+
+// mergeNode merges the mapping src into dst. Nested mappings are merged, any
+// other value replaces the one in dst.
+func mergeNode(dst, src *yaml.Node) {
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		*dst = *src
+		return
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value == key.Value {
+				if dst.Content[j+1].Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+					mergeNode(dst.Content[j+1], value)
+				} else {
+					dst.Content[j], dst.Content[j+1] = key, value
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.Content = append(dst.Content, key, value)
+		}
+	}
+}
+
+// locate maps a global line number back to the layer it came from and the
+// line within that layer
+func locate(layers []configLayer, line int) (configLayer, int) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if line >= layers[i].first {
+			return layers[i], line - layers[i].first + 1
+		}
+	}
+	return configLayer{}, line
+}
+
+// configKey is a config field that can be set from the environment
+type configKey struct {
+	path      []string
+	fieldType reflect.Type
+}
+
+// configKeys maps environment variable names without the prefix to config
+// fields, e.g. PRESERVE_MTIME to preserve.mtime. Lists of structures such as
+// watchDirs are a single variable holding YAML.
+func configKeys() map[string]configKey {
+	keys := make(map[string]configKey)
+	var walk func(t reflect.Type, path []string)
+	walk = func(t reflect.Type, path []string) {
+		for name, fieldType := range yamlFields(t) {
+			fieldPath := append(append([]string(nil), path...), name)
+			if fieldType.Kind() == reflect.Struct && fieldType != reflect.TypeOf(time.Time{}) {
+				walk(fieldType, fieldPath)
+				continue
+			}
+			envPath := make([]string, len(fieldPath))
+			for i, part := range fieldPath {
+				envPath[i] = envName(part)
+			}
+			keys[strings.Join(envPath, "_")] = configKey{path: fieldPath, fieldType: fieldType}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), nil)
+	return keys
+}
+
+// envName turns a camelCase field name into SNAKE_CASE, e.g. minFileSize into MIN_FILE_SIZE
+func envName(field string) string {
+	var b strings.Builder
+	runes := []rune(field)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// fieldType returns the type of the config field at path, or nil if there is none
+func fieldType(t reflect.Type, path []string) reflect.Type {
+	for _, name := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		var ok bool
+		if t, ok = yamlFields(t)[name]; !ok {
+			return nil
+		}
+	}
+	return t
+}
+
+// settingNode builds a document setting the field at path to value. Lists are
+// written as YAML or as comma separated values, strings are never reinterpreted.
+func settingNode(path []string, value string, t reflect.Type) *yaml.Node {
+	leaf := &yaml.Node{Kind: yaml.ScalarNode, Value: value, Line: 1}
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	trimmed := strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{"):
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(value), &doc); err == nil && len(doc.Content) > 0 {
+			leaf = doc.Content[0]
+		}
+	case t != nil && t.Kind() == reflect.Slice:
+		leaf = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: 1}
+		for _, item := range strings.Split(value, ",") {
+			leaf.Content = append(leaf.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: strings.TrimSpace(item), Line: 1})
+		}
+	case t != nil && t.Kind() == reflect.String:
+		leaf.Tag = "!!str"
+	}
+	setLines(leaf, 1)
+
+	node := leaf
+	for i := len(path) - 1; i >= 0; i-- {
+		node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: 1, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: path[i], Line: 1},
+			node,
+		}}
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Content: []*yaml.Node{node}}
+}
+
+// setLines puts node and everything below it on line
+func setLines(node *yaml.Node, line int) {
+	node.Line = line
+	for _, child := range node.Content {
+		setLines(child, line)
+	}
+}
+
+// runShowConfig prints the merged config with the source of every value
+func runShowConfig(path string) int {
+	layers, problems, err := configLayers(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s\n", problem)
+	}
+
+	merged := mergeLayers(layers)
+	annotateSources(merged.Content[0], layers)
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(merged); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	encoder.Close()
+	os.Stdout.Write(out.Bytes())
+	return 0
+}
+
+// annotateSources replaces the comments of node with the source of each value
+func annotateSources(node *yaml.Node, layers []configLayer) {
+	source := func(n *yaml.Node) string {
+		layer, line := locate(layers, n.Line)
+		if layer.file {
+			return fmt.Sprintf("%s:%d", layer.name, line)
+		}
+		return layer.name
+	}
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		n.HeadComment, n.LineComment, n.FootComment = "", "", ""
+		if n.Kind != yaml.ScalarNode {
+			n.Style &^= yaml.FlowStyle
+		}
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key, value := n.Content[i], n.Content[i+1]
+				walk(key)
+				walk(value)
+				switch {
+				case value.Kind == yaml.ScalarNode:
+					value.LineComment = source(value)
+				case value.Kind == yaml.SequenceNode && scalarsOnly(value):
+					value.Style = yaml.FlowStyle
+					value.LineComment = source(value)
+				case value.Kind == yaml.SequenceNode:
+					key.LineComment = source(value)
+				}
+			}
+		case yaml.SequenceNode:
+			mixed := !scalarsOnly(n)
+			for _, child := range n.Content {
+				walk(child)
+				if mixed && child.Kind == yaml.ScalarNode {
+					child.LineComment = source(child)
+				}
+			}
+		}
+	}
+	walk(node)
+}
+
+// scalarsOnly reports whether the sequence node holds nothing but scalars
+func scalarsOnly(node *yaml.Node) bool {
+	for _, child := range node.Content {
+		if child.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseYAML returns the document node of data
+func parseYAML(t *testing.T, data string) *yaml.Node {
+	t.Helper()
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(data), &root); err != nil {
+		t.Fatal(err)
+	}
+	return &root
+}
+
+// marshalNode formats node the way yaml.v3 writes it
+func marshalNode(t *testing.T, node *yaml.Node) string {
+	t.Helper()
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMergeLayers(t *testing.T) {
+	layers := []configLayer{
+		{root: parseYAML(t, "verify: hash\npreserve:\n  mtime: true\n  xattrs: true\nrawExtensions: [.cr2, .nef]\n")},
+		{root: parseYAML(t, "preserve:\n  xattrs: false\nrawExtensions: [.dng]\nminFileSize: 0\n")},
+	}
+	got := marshalNode(t, mergeLayers(layers))
+	want := "verify: hash\npreserve:\n    mtime: true\n    xattrs: false\nrawExtensions: [.dng]\nminFileSize: 0\n"
+	if got != want {
+		t.Errorf("merged:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for field, want := range map[string]string{
+		"minFileSize":            "MIN_FILE_SIZE",
+		"verify":                 "VERIFY",
+		"rawDestinationTemplate": "RAW_DESTINATION_TEMPLATE",
+		"maxFuture":              "MAX_FUTURE",
+		"webhookURL":             "WEBHOOK_URL",
+		"h264Quality":            "H264_QUALITY",
+	} {
+		if got := envName(field); got != want {
+			t.Errorf("envName(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestSettingNode(t *testing.T) {
+	tests := []struct {
+		path  []string
+		value string
+		want  string
+	}{
+		{[]string{"minFileSize"}, "1024", "minFileSize: 1024\n"},
+		{[]string{"preserve", "mtime"}, "true", "preserve:\n    mtime: true\n"},
+		// Comma separated and YAML lists
+		{[]string{"rawExtensions"}, ".cr2, .nef", "rawExtensions:\n    - .cr2\n    - .nef\n"},
+		{[]string{"rawExtensions"}, "[.dng]", "rawExtensions: [.dng]\n"},
+		// A string field keeps values that look like other types
+		{[]string{"destinationTemplate"}, "2024", "destinationTemplate: \"2024\"\n"},
+	}
+	for _, test := range tests {
+		node := settingNode(test.path, test.value, fieldType(reflect.TypeOf(Config{}), test.path))
+		if got := marshalNode(t, node); got != test.want {
+			t.Errorf("%s=%s:\n%s\nwant:\n%s", strings.Join(test.path, "."), test.value, got, test.want)
+		}
+	}
+}
+
+// Problems point at the file, environment variable or flag of the value,
+// whichever layer last set it
+func TestConfigLayerProblems(t *testing.T) {
+	dir := t.TempDir()
+	watch, destination := filepath.Join(dir, "watch"), filepath.Join(dir, "photos")
+	for _, d := range []string{watch, destination} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "config.yml")
+	config := "watchDirs: [" + watch + "]\ndefaultDestinationDir: " + destination + "\nverify: hash\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "config.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(dir, "config.d", "10-extra.yml")
+	if err := os.WriteFile(extra, []byte("# Comment\nminFileSize: 0\nverfy: size\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MOVEPHOTO_MAX_FILE_SIZE", "lots")
+	t.Setenv("MOVEPHOTO_HOOK_EVENT", "imported")
+	saved := setSettings
+	setSettings = settingList{"checksum=sha256", "verify"}
+	defer func() { setSettings = saved }()
+
+	_, problems, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"-set verify: error: expected -set key=value": false,
+		extra + ":3: error: unknown field \"verfy\"":  false,
+		"MOVEPHOTO_MAX_FILE_SIZE: error: ":            false,
+	}
+	for _, problem := range problems {
+		s := problem.String()
+		matched := false
+		for prefix := range want {
+			if strings.HasPrefix(s, prefix) {
+				want[prefix], matched = true, true
+			}
+		}
+		if !matched {
+			t.Errorf("unexpected problem %s", s)
+		}
+	}
+	for prefix, found := range want {
+		if !found {
+			t.Errorf("no problem starting with %q", prefix)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"movephoto/logging"
+)
+
+// instanceLock is the advisory lock that keeps two instances from processing
+// the same watch directories at the same time
+type instanceLock struct {
+	path string
+	file *os.File
+}
+
+// errLocked is returned by tryLock when another process holds the lock
+type errLocked struct {
+	pid int // 0 when the holder is unknown
+}
+
+func (e *errLocked) Error() string {
+	if e.pid == 0 {
+		return "lock is held by another process"
+	}
+	return fmt.Sprintf("lock is held by another instance (PID %d)", e.pid)
+}
+
+// acquireLock takes the lock at path, waiting up to timeout for another
+// instance to release it. A timeout of 0 fails straight away.
+func acquireLock(path string, timeout time.Duration) (*instanceLock, error) {
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		lock, err := tryLock(path)
+		if err == nil {
+			return lock, nil
+		}
+		locked, ok := err.(*errLocked)
+		if !ok {
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s: %v", path, locked)
+		}
+		if !waiting {
+			slog.Info("Waiting for the lock file", "path", path, "timeout", timeout, logging.Err(locked))
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// writePID records the current process in the lock file
+func (l *instanceLock) writePID() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// readLockPID returns the PID recorded in the lock file at path, or 0
+func readLockPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// noteStaleLock logs when the lock file still names a process that is gone,
+// which happens when an earlier instance crashed or was killed
+func noteStaleLock(path string, pid int) {
+	if pid != 0 && pid != os.Getpid() && !processRunning(pid) {
+		slog.Warn("Taking over stale lock", "path", path, "pid", pid)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on path without blocking. The kernel drops
+// the lock when the process dies, so a crashed instance never blocks the next
+// one; the PID in the file is only used for messages.
+func tryLock(path string) (*instanceLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, &errLocked{pid: readLockPID(path)}
+		}
+		return nil, err
+	}
+
+	noteStaleLock(path, readLockPID(path))
+
+	lock := &instanceLock{path: path, file: file}
+	if err := lock.writePID(); err != nil {
+		lock.release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// release clears the PID and drops the lock. The file itself is left in
+// place; removing it would let a waiting instance lock an unlinked inode.
+func (l *instanceLock) release() {
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+// processRunning reports whether a process with the given PID exists
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
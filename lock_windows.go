@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+)
+
+// tryLock creates the lock file exclusively. Windows has no flock, so a lock
+// file whose PID no longer runs is treated as stale and replaced.
+func tryLock(path string) (*instanceLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		pid := readLockPID(path)
+		if pid != 0 && processRunning(pid) {
+			return nil, &errLocked{pid: pid}
+		}
+		noteStaleLock(path, pid)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &instanceLock{path: path, file: file}
+	if err := lock.writePID(); err != nil {
+		lock.release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// release removes the lock file
+func (l *instanceLock) release() {
+	l.file.Close()
+	os.Remove(l.path)
+}
+
+// processRunning reports whether a process with the given PID exists
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
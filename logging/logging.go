@@ -0,0 +1,127 @@
+// Package logging sets up the leveled slog logger shared by movephoto and the
+// dedupe tool, writing text, JSON or journald-friendly lines to stderr or a
+// rotated log file.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Options selects the level, format and destination of the log
+type Options struct {
+	Level    string // "debug", "info", "warn" or "error"
+	Format   string // "text", "json", "journal" or "auto"
+	File     string // Log file, empty for stderr
+	MaxSize  int64  // Megabytes before the log file is rotated, 0 never rotates
+	MaxFiles int    // Rotated log files kept
+}
+
+// AddFlags registers the logging flags on fs
+func AddFlags(fs *flag.FlagSet) *Options {
+	opts := &Options{}
+	fs.StringVar(&opts.Level, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.StringVar(&opts.Format, "log-format", "auto", "Log format: text, json, journal or auto (journal when started by systemd, text otherwise)")
+	fs.StringVar(&opts.File, "log-file", "", "Write the log to this file instead of stderr")
+	fs.Int64Var(&opts.MaxSize, "log-max-size", 10, "Size in megabytes at which the log file is rotated, 0 disables rotation")
+	fs.IntVar(&opts.MaxFiles, "log-max-files", 5, "Number of rotated log files to keep")
+	return opts
+}
+
+// Setup makes the logger described by opts the default of both slog and the
+// log package. The returned function closes the log file.
+func Setup(opts Options) (func() error, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", opts.Level)
+	}
+
+	var out io.Writer = os.Stderr
+	closeLog := func() error { return nil }
+	if opts.File != "" {
+		file, err := openRotating(opts.File, opts.MaxSize*1024*1024, opts.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		out, closeLog = file, file.Close
+	}
+
+	format := opts.Format
+	if format == "auto" {
+		format = "text"
+		// systemd sets JOURNAL_STREAM when stderr is connected to the journal
+		if opts.File == "" && os.Getenv("JOURNAL_STREAM") != "" {
+			format = "journal"
+		}
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(out, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	case "journal":
+		// The journal records the time itself and reads the priority from a
+		// <N> prefix, so leave out the timestamp and translate the level
+		handlerOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+		handler = slog.NewTextHandler(&journalWriter{out: out}, handlerOpts)
+	default:
+		closeLog()
+		return nil, fmt.Errorf("invalid log format %q", opts.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+	return closeLog, nil
+}
+
+// journalWriter prefixes every line written by a text handler with the
+// sd-daemon priority of its level
+type journalWriter struct {
+	out io.Writer
+}
+
+// journalPriorities maps slog levels to syslog priorities
+var journalPriorities = map[string]string{
+	"DEBUG": "<7>",
+	"INFO":  "<6>",
+	"WARN":  "<4>",
+	"ERROR": "<3>",
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	priority := "<6>"
+	if rest, ok := strings.CutPrefix(string(p), "level="); ok {
+		level, _, _ := strings.Cut(rest, " ")
+		if prefix, ok := journalPriorities[level]; ok {
+			priority = prefix
+		}
+	}
+	if _, err := io.WriteString(w.out, priority); err != nil {
+		return 0, err
+	}
+	return w.out.Write(p)
+}
+
+// Err returns an attribute for err under the "error" key
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+// Fatal logs msg at the error level and exits with status 1
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// rotatingFile is a log file that is renamed to path.1, path.2, ... once it
+// grows past maxSize, keeping at most maxFiles old files
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// openRotating opens the log file at path for appending
+func openRotating(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the current log file
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the full file rather than losing lines
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old log files up by one and starts a new one
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			r.open()
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		r.open()
+		return err
+	}
+	return r.open()
+}
+
+// Close closes the log file
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
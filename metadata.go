@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"movephoto/logging"
+	"movephoto/metadata"
+)
+
+// mediaMetadata holds the metadata fields read from a file. It is read once
+// per file and used both for dating and for matching rules.
+type mediaMetadata struct {
+	metadata.Fields
+}
+
+// metadataReader reads the metadata of files with the backend of the config
+var metadataReader, _ = metadata.New(metadata.Native)
+
+// useMetadataBackend switches metadataReader to backend. The config check
+// makes sure it exists, but ExifTool may have been uninstalled since.
+func useMetadataBackend(backend string) {
+	reader, err := metadata.New(backend)
+	if err != nil {
+		slog.Error("Failed to set up the metadata backend, reading metadata natively", "backend", backend, logging.Err(err))
+		reader, _ = metadata.New(metadata.Native)
+	}
+	metadataReader = reader
+}
+
+// readMetadata extracts all metadata of a file. A file that crashes the
+// reader gets an error wrapping metadata.ErrCorrupt.
+func readMetadata(filePath string) (meta mediaMetadata, err error) {
+	start := time.Now()
+	defer func() { metadataReadDuration.Observe(time.Since(start).Seconds()) }()
+	defer func() {
+		if r := recover(); r != nil {
+			meta, err = mediaMetadata{}, fmt.Errorf("%s: %w: %v", filePath, metadata.ErrCorrupt, r)
+		}
+	}()
+
+	fields, err := metadataReader.Read(filePath)
+	if err != nil {
+		return mediaMetadata{}, err
+	}
+	return mediaMetadata{fields}, nil
+}
+
+// Make returns the camera manufacturer
+func (m mediaMetadata) Make() string {
+	return m.String("Make")
+}
+
+// Model returns the camera model
+func (m mediaMetadata) Model() string {
+	return m.String("Model")
+}
+
+// Dimensions returns the width and height in pixels. ImageWidth of RAW files
+// read by ExifTool can be that of the thumbnail in their first directory, so
+// the larger of the two sizes a file records wins.
+func (m mediaMetadata) Dimensions() (int, int) {
+	width, height := m.Number("ImageWidth"), m.Number("ImageHeight")
+	if w, h := m.Number("ExifImageWidth"), m.Number("ExifImageHeight"); w*h > width*height {
+		width, height = w, h
+	}
+	return int(width), int(height)
+}
+
+// durationPattern matches ExifTool's H:MM:SS duration format
+var durationPattern = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2}(?:\.\d+)?)$`)
+
+// Duration returns the length of a video. ExifTool reports short durations as
+// "12.34 s" and longer ones as "0:01:05".
+func (m mediaMetadata) Duration() time.Duration {
+	value := m.String("Duration", "MediaDuration", "TrackDuration")
+	if match := durationPattern.FindStringSubmatch(value); match != nil {
+		hours, _ := strconv.Atoi(match[1])
+		minutes, _ := strconv.Atoi(match[2])
+		seconds, _ := strconv.ParseFloat(match[3], 64)
+		return time.Duration((float64(hours*3600+minutes*60) + seconds) * float64(time.Second))
+	}
+	return time.Duration(m.Number("Duration", "MediaDuration", "TrackDuration") * float64(time.Second))
+}
+
+// HasGPS reports whether the file carries a location
+func (m mediaMetadata) HasGPS() bool {
+	return m.String("GPSLatitude", "GPSPosition", "GPSCoordinates") != ""
+}
+
+// screenshotPattern matches the filenames phones and desktops give screenshots
+var screenshotPattern = regexp.MustCompile(`(?i)screen[ _-]?shot`)
+
+// IsScreenshot guesses whether the file named name is a screenshot. iOS marks
+// them in UserComment, Android and desktops put it in the filename.
+func (m mediaMetadata) IsScreenshot(name string) bool {
+	return screenshotPattern.MatchString(name) ||
+		strings.EqualFold(m.String("UserComment"), "Screenshot")
+}
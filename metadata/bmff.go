@@ -0,0 +1,450 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ISO base media files (MP4, QuickTime, HEIF) are a tree of boxes, each with
+// a size and a four character type. See ISO/IEC 14496-12 and 23008-12.
+
+// box is a box found in a file
+type box struct {
+	typ    string
+	offset int64 // Of the payload
+	size   int64 // Of the payload
+}
+
+// maxItemSize limits the metadata items read from HEIF files
+const maxItemSize = 1 << 20
+
+// bmffTopLevel are the types of boxes that can start a file
+var bmffTopLevel = []string{"ftyp", "moov", "mdat", "wide", "free", "skip", "pnot"}
+
+// heifBrands are the ftyp brands of HEIF images, as opposed to videos
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1", "avif", "avis"}
+
+// quickTimeEpoch is the zero of the dates in QuickTime and MP4 files
+var quickTimeEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// isBMFF reports whether a file starting with header is an ISO base media file
+func isBMFF(header []byte) bool {
+	if len(header) < 8 {
+		return false
+	}
+	for _, typ := range bmffTopLevel {
+		if string(header[4:8]) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// readBoxes returns the boxes between start and end
+func readBoxes(r io.ReaderAt, start, end int64) []box {
+	var boxes []box
+	for offset := start; offset+8 <= end; {
+		var header [16]byte
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = end - offset // To the end of the file
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return boxes
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || offset+size > end {
+			break
+		}
+		boxes = append(boxes, box{typ: string(header[4:8]), offset: offset + headerSize, size: size - headerSize})
+		offset += size
+	}
+	return boxes
+}
+
+// children returns the boxes inside b, skipping skip bytes of b's own fields first
+func children(r io.ReaderAt, b box, skip int64) []box {
+	return readBoxes(r, b.offset+skip, b.offset+b.size)
+}
+
+// findBox returns the first of boxes of type typ
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+// findPath follows a path of box types down from boxes
+func findPath(r io.ReaderAt, boxes []box, path ...string) (box, bool) {
+	var b box
+	for i, typ := range path {
+		var ok bool
+		if b, ok = findBox(boxes, typ); !ok {
+			return box{}, false
+		}
+		if i < len(path)-1 {
+			boxes = children(r, b, 0)
+		}
+	}
+	return b, true
+}
+
+// payload reads up to limit bytes of the payload of b
+func payload(r io.ReaderAt, b box, limit int64) []byte {
+	size := b.size
+	if size > limit {
+		size = limit
+	}
+	data := make([]byte, size)
+	n, _ := r.ReadAt(data, b.offset)
+	return data[:n]
+}
+
+// readBMFF reads the metadata of an MP4, QuickTime, HEIF or CR3 file of the given size
+func readBMFF(r io.ReaderAt, size int64, fields Fields) error {
+	top := readBoxes(r, 0, size)
+	if ftyp, ok := findBox(top, "ftyp"); ok {
+		brands := payload(r, ftyp, 256)
+		switch {
+		case hasBrand(brands, []string{"crx "}):
+			return readCR3(r, top, fields)
+		case hasBrand(brands, heifBrands):
+			return readHEIF(r, top, fields)
+		}
+	}
+	return readQuickTime(r, top, fields)
+}
+
+// hasBrand reports whether the payload of an ftyp box lists one of brands as
+// its major or a compatible brand
+func hasBrand(ftyp []byte, brands []string) bool {
+	for i := 0; i+4 <= len(ftyp); i += 4 {
+		if i == 4 {
+			continue // Minor version
+		}
+		for _, brand := range brands {
+			if string(ftyp[i:i+4]) == brand {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readQuickTime reads the dates, duration, dimensions and location of a video
+func readQuickTime(r io.ReaderAt, top []box, fields Fields) error {
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return fmt.Errorf("no movie header found")
+	}
+	movie := children(r, moov, 0)
+
+	if mvhd, ok := findBox(movie, "mvhd"); ok {
+		created, modified, timescale, duration := headerTimes(payload(r, mvhd, 32))
+		setQuickTimeDate(fields, "CreateDate", created)
+		setQuickTimeDate(fields, "ModifyDate", modified)
+		if timescale > 0 {
+			fields["Duration"] = float64(duration) / float64(timescale)
+		}
+	}
+
+	for _, trak := range movie {
+		if trak.typ != "trak" {
+			continue
+		}
+		track := children(r, trak, 0)
+		if tkhd, ok := findBox(track, "tkhd"); ok {
+			data := payload(r, tkhd, 96)
+			created, modified, _, _ := headerTimes(data)
+			if _, ok := fields["TrackCreateDate"]; !ok {
+				setQuickTimeDate(fields, "TrackCreateDate", created)
+				setQuickTimeDate(fields, "TrackModifyDate", modified)
+			}
+			// Width and height are 16.16 fixed point numbers after the matrix
+			at := 76
+			if len(data) > 0 && data[0] == 1 {
+				at = 88
+			}
+			if len(data) >= at+8 && fields.Number("ImageWidth") == 0 {
+				width := binary.BigEndian.Uint32(data[at:]) >> 16
+				height := binary.BigEndian.Uint32(data[at+4:]) >> 16
+				if width > 0 && height > 0 {
+					fields["ImageWidth"], fields["ImageHeight"] = float64(width), float64(height)
+				}
+			}
+		}
+		if mdhd, ok := findPath(r, track, "mdia", "mdhd"); ok {
+			created, modified, timescale, duration := headerTimes(payload(r, mdhd, 32))
+			if _, ok := fields["MediaCreateDate"]; !ok {
+				setQuickTimeDate(fields, "MediaCreateDate", created)
+				setQuickTimeDate(fields, "MediaModifyDate", modified)
+				if timescale > 0 {
+					fields["MediaDuration"] = float64(duration) / float64(timescale)
+				}
+			}
+		}
+	}
+
+	if xyz, ok := findPath(r, movie, "udta", "\xa9xyz"); ok {
+		// A 16 bit length and language before the ISO 6709 string
+		if data := payload(r, xyz, 256); len(data) > 4 {
+			fields["GPSCoordinates"] = strings.TrimRight(string(data[4:]), "\x00")
+		}
+	}
+	if meta, ok := findBox(movie, "meta"); ok {
+		readAppleKeys(r, meta, fields)
+	}
+	return nil
+}
+
+// headerTimes returns the creation and modification time, time scale and
+// duration of an mvhd, tkhd or mdhd box. tkhd has a track ID where the
+// others have the time scale.
+func headerTimes(data []byte) (created, modified uint64, timescale uint32, duration uint64) {
+	if len(data) >= 32 && data[0] == 1 {
+		return binary.BigEndian.Uint64(data[4:]), binary.BigEndian.Uint64(data[12:]), binary.BigEndian.Uint32(data[20:]), binary.BigEndian.Uint64(data[24:])
+	}
+	if len(data) >= 20 {
+		return uint64(binary.BigEndian.Uint32(data[4:])), uint64(binary.BigEndian.Uint32(data[8:])), binary.BigEndian.Uint32(data[12:]), uint64(binary.BigEndian.Uint32(data[16:]))
+	}
+	return 0, 0, 0, 0
+}
+
+// setQuickTimeDate sets tag to a date in seconds since 1904, in UTC like
+// ExifTool prints it. Cameras without a clock write 0, which is left out.
+func setQuickTimeDate(fields Fields, tag string, seconds uint64) {
+	if seconds == 0 {
+		return
+	}
+	fields[tag] = quickTimeEpoch.Add(time.Duration(seconds) * time.Second).Format("2006:01:02 15:04:05")
+}
+
+// appleKeys maps the keys of the metadata Apple devices write to ExifTool tags
+var appleKeys = map[string]string{
+	"com.apple.quicktime.creationdate":     "CreationDate",
+	"com.apple.quicktime.location.ISO6709": "GPSCoordinates",
+	"com.apple.quicktime.make":             "Make",
+	"com.apple.quicktime.model":            "Model",
+}
+
+// readAppleKeys reads the keys and values of a QuickTime meta box. The
+// creation date has the time zone of the phone, unlike the other dates.
+func readAppleKeys(r io.ReaderAt, meta box, fields Fields) {
+	boxes := children(r, meta, 0)
+	if _, ok := findBox(boxes, "hdlr"); !ok {
+		boxes = children(r, meta, 4) // The MP4 flavour has a version and flags
+	}
+	keysBox, ok := findBox(boxes, "keys")
+	if !ok {
+		return
+	}
+	ilst, ok := findBox(boxes, "ilst")
+	if !ok {
+		return
+	}
+
+	data := payload(r, keysBox, 64*1024)
+	var keys []string
+	for at := 8; at+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[at:]))
+		if size < 8 || at+size > len(data) {
+			break
+		}
+		keys = append(keys, string(data[at+8:at+size]))
+		at += size
+	}
+
+	for _, item := range children(r, ilst, 0) {
+		index := int(binary.BigEndian.Uint32([]byte(item.typ))) - 1
+		if index < 0 || index >= len(keys) {
+			continue
+		}
+		tag, ok := appleKeys[keys[index]]
+		if !ok {
+			continue
+		}
+		if value, ok := findBox(children(r, item, 0), "data"); ok {
+			// A type and a locale before the value
+			if data := payload(r, value, 1024); len(data) > 8 {
+				fields[tag] = appleValue(tag, string(data[8:]))
+			}
+		}
+	}
+}
+
+// appleValue converts a value of Apple metadata to the way ExifTool prints it
+func appleValue(tag, value string) string {
+	if tag != "CreationDate" {
+		return value
+	}
+	if date, err := time.Parse("2006-01-02T15:04:05-0700", value); err == nil {
+		return date.Format("2006:01:02 15:04:05-07:00")
+	}
+	return value
+}
+
+// readHEIF reads the EXIF data and the dimensions of a HEIF image
+func readHEIF(r io.ReaderAt, top []box, fields Fields) error {
+	metaBox, ok := findBox(top, "meta")
+	if !ok {
+		return fmt.Errorf("no meta box found")
+	}
+	meta := children(r, metaBox, 4)
+
+	if ipco, ok := findPath(r, meta, "iprp", "ipco"); ok {
+		// The largest image spatial extent is that of the full image, the
+		// others are tiles and thumbnails
+		var width, height uint32
+		for _, ispe := range children(r, ipco, 0) {
+			if ispe.typ != "ispe" {
+				continue
+			}
+			if data := payload(r, ispe, 12); len(data) == 12 {
+				w, h := binary.BigEndian.Uint32(data[4:]), binary.BigEndian.Uint32(data[8:])
+				if uint64(w)*uint64(h) > uint64(width)*uint64(height) {
+					width, height = w, h
+				}
+			}
+		}
+		if width > 0 {
+			fields["ImageWidth"], fields["ImageHeight"] = float64(width), float64(height)
+		}
+	}
+
+	iinf, ok := findBox(meta, "iinf")
+	if !ok {
+		return nil
+	}
+	iloc, ok := findBox(meta, "iloc")
+	if !ok {
+		return nil
+	}
+	id, ok := exifItem(r, iinf)
+	if !ok {
+		return nil
+	}
+	data := itemData(r, payload(r, iloc, maxItemSize), id)
+	if len(data) < 4 {
+		return nil
+	}
+	// The EXIF item starts with the offset of the TIFF header
+	start := 4 + int(binary.BigEndian.Uint32(data))
+	if start >= len(data) {
+		return nil
+	}
+	readExif(data[start:], fields)
+	return nil
+}
+
+// exifItem returns the ID of the EXIF item listed in an iinf box
+func exifItem(r io.ReaderAt, iinf box) (uint32, bool) {
+	data := payload(r, iinf, 8)
+	skip := int64(6) // Version, flags and a 16 bit entry count
+	if len(data) > 0 && data[0] != 0 {
+		skip = 8
+	}
+	for _, infe := range children(r, iinf, skip) {
+		if infe.typ != "infe" {
+			continue
+		}
+		data := payload(r, infe, 16)
+		if len(data) < 12 {
+			continue
+		}
+		switch data[0] {
+		case 2:
+			if string(data[8:12]) == "Exif" {
+				return uint32(binary.BigEndian.Uint16(data[4:])), true
+			}
+		case 3:
+			if len(data) >= 14 && string(data[10:14]) == "Exif" {
+				return binary.BigEndian.Uint32(data[4:]), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// itemData reads the data of item id from the file, using the locations in
+// the payload of an iloc box. Only items stored in the file itself are read.
+func itemData(r io.ReaderAt, iloc []byte, id uint32) []byte {
+	p := &fieldReader{data: iloc}
+	version := p.uint(1)
+	p.uint(3) // Flags
+	sizes := p.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0xf)
+	sizes = p.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), int(sizes&0xf)
+	if version == 0 {
+		indexSize = 0
+	}
+	count := p.uint(2)
+	if version == 2 {
+		count = p.uint(4)
+	}
+
+	for i := uint64(0); i < count && !p.failed; i++ {
+		itemID := p.uint(2)
+		if version == 2 {
+			itemID = p.uint(4)
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = p.uint(2) & 0xf
+		}
+		p.uint(2) // Data reference index
+		base := p.uint(baseOffsetSize)
+		extents := p.uint(2)
+		var data []byte
+		for j := uint64(0); j < extents && !p.failed; j++ {
+			p.uint(indexSize)
+			offset := p.uint(offsetSize)
+			length := p.uint(lengthSize)
+			if uint32(itemID) != id || method != 0 || length > maxItemSize || len(data)+int(length) > maxItemSize {
+				continue
+			}
+			extent := make([]byte, length)
+			n, _ := r.ReadAt(extent, int64(base+offset))
+			data = append(data, extent[:n]...)
+		}
+		if uint32(itemID) == id {
+			return data
+		}
+	}
+	return nil
+}
+
+// fieldReader reads big-endian numbers of varying sizes from data, noting
+// when it runs out
+type fieldReader struct {
+	data   []byte
+	at     int
+	failed bool
+}
+
+// uint reads an unsigned number of size bytes, 0 for an empty field
+func (p *fieldReader) uint(size int) uint64 {
+	if p.at+size > len(p.data) {
+		p.failed = true
+		return 0
+	}
+	var n uint64
+	for _, b := range p.data[p.at : p.at+size] {
+		n = n<<8 | uint64(b)
+	}
+	p.at += size
+	return n
+}
@@ -0,0 +1,262 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// exifNames maps the goexif names of tags to the ExifTool ones where they differ
+var exifNames = map[exif.FieldName]string{
+	exif.DateTime:          "ModifyDate",
+	exif.DateTimeDigitized: "CreateDate",
+	exif.ImageLength:       "ImageHeight",
+	exif.PixelXDimension:   "ExifImageWidth",
+	exif.PixelYDimension:   "ExifImageHeight",
+}
+
+// extraExifTags are tags of the EXIF directory goexif doesn't know, by ID
+var extraExifTags = map[uint16]string{
+	0x9010: "OffsetTime",
+	0x9011: "OffsetTimeOriginal",
+	0x9012: "OffsetTimeDigitized",
+	0xa431: "BodySerialNumber",
+}
+
+// maxExifSize limits the EXIF data read from a file. The APP1 segment of a
+// JPEG holds 64 KB at most, and TIFF files keep theirs near the start.
+const maxExifSize = 1 << 20
+
+// maxConvertedSize limits the values of a tag goexif converts to numbers,
+// which take up to 8 times the space of the raw value
+const maxConvertedSize = 1 << 20
+
+// typeSizes are the sizes of the TIFF value types by their number
+var typeSizes = map[uint16]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// Tags that point at the directories goexif and this package read
+var directoryPointers = map[uint16]bool{
+	0x8769: true, // ExifIFDPointer
+	0x8825: true, // GPSInfoIFDPointer
+	0xa005: true, // InteroperabilityIFDPointer
+	0x14a:  true, // SubIFDs
+}
+
+// readExif reads the EXIF tags of a JPEG or a TIFF block into fields
+func readExif(data []byte, fields Fields) error {
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		var err error
+		if data, err = jpegExif(data); err != nil {
+			return err
+		}
+	}
+	if err := checkTIFF(data); err != nil {
+		return err
+	}
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	x.Walk(exifWalker(fields))
+
+	// goexif drops the tags it has no name for. They are in the EXIF
+	// directory, or in the first one for the EXIF block of a CR3 file.
+	var dirs []*tiff.Dir
+	if len(x.Tiff.Dirs) > 0 {
+		dirs = x.Tiff.Dirs[:1]
+	}
+	if pointer, err := x.Get(exif.ExifIFDPointer); err == nil {
+		offset, err := pointer.Int64(0)
+		if err == nil && offset > 0 && offset < int64(len(x.Raw)) {
+			dirReader := bytes.NewReader(x.Raw)
+			dirReader.Seek(offset, io.SeekStart)
+			if dir, _, err := tiff.DecodeDir(dirReader, x.Tiff.Order); err == nil {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		for _, tag := range dir.Tags {
+			if name, ok := extraExifTags[tag.Id]; ok {
+				if value, ok := exifValue(exif.FieldName(name), tag); ok {
+					fields[name] = value
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// jpegExif returns the TIFF block in the APP1 segment of a JPEG
+func jpegExif(data []byte) ([]byte, error) {
+	for at := 2; at+4 <= len(data); {
+		if data[at] != 0xff {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker := data[at+1]
+		switch {
+		case marker == 0xff: // Fill byte
+			at++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7: // No length
+			at += 2
+			continue
+		case marker == 0xda || marker == 0xd9: // Start of scan or end of image
+			return nil, errors.New("no EXIF data found")
+		}
+		end := at + 2 + int(binary.BigEndian.Uint16(data[at+2:]))
+		if end < at+4 {
+			return nil, errors.New("invalid JPEG segment length")
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		if segment := data[at+4 : end]; marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		at = end
+	}
+	return nil, errors.New("no EXIF data found")
+}
+
+// checkTIFF makes sure that every tag of the directories read from a TIFF
+// block has no more values than fit in it. goexif allocates the values of a
+// tag by its count, which a corrupt file can set to billions.
+func checkTIFF(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("short TIFF header")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	seen := make(map[uint32]bool)
+	var checkDir func(offset uint32, chain bool) error
+	checkDir = func(offset uint32, chain bool) error {
+		for offset != 0 && !seen[offset] && len(seen) < 256 {
+			seen[offset] = true
+			if uint64(offset)+2 > uint64(len(data)) {
+				return nil // goexif fails on the directory itself
+			}
+			entries := data[offset+2:]
+			count := int(order.Uint16(data[offset:]))
+			if count*12 > len(entries) {
+				count, chain = len(entries)/12, false
+			}
+			for i := 0; i < count; i++ {
+				entry := entries[12*i : 12*i+12]
+				id, typ, n := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+				size := typeSizes[typ] * uint64(n)
+				if size > uint64(len(data)) || typ != 2 && typ != 7 && size > maxConvertedSize {
+					return fmt.Errorf("tag %#x has %d values, more than fit", id, n)
+				}
+				if !directoryPointers[id] || typ != 4 {
+					continue
+				}
+				pointers := entry[8:]
+				if size > 4 {
+					valueAt := uint64(order.Uint32(pointers))
+					if valueAt+size > uint64(len(data)) {
+						continue
+					}
+					pointers = data[valueAt : valueAt+size]
+				}
+				for j := 0; j+4 <= len(pointers); j += 4 {
+					if err := checkDir(order.Uint32(pointers[j:]), false); err != nil {
+						return err
+					}
+				}
+			}
+			if !chain || 12*count+4 > len(entries) {
+				return nil
+			}
+			offset = order.Uint32(entries[12*count:])
+		}
+		return nil
+	}
+	return checkDir(order.Uint32(data[4:]), true)
+}
+
+// exifWalker copies the tags goexif knows into fields
+type exifWalker Fields
+
+func (w exifWalker) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	value, ok := exifValue(name, tag)
+	if !ok {
+		return nil
+	}
+	key := string(name)
+	if mapped, ok := exifNames[name]; ok {
+		key = mapped
+	}
+	w[key] = value
+	return nil
+}
+
+// exifValue converts a tag to a string or a number the way ExifTool prints it
+func exifValue(name exif.FieldName, tag *tiff.Tag) (interface{}, bool) {
+	switch {
+	case name == exif.UserComment:
+		// Undefined bytes behind an 8 byte character code
+		if len(tag.Val) <= 8 {
+			return nil, false
+		}
+		return strings.TrimRight(string(tag.Val[8:]), "\x00 "), true
+	case name == exif.GPSTimeStamp && tag.Count == 3:
+		var parts [3]float64
+		for i := range parts {
+			parts[i], _ = rational(tag, i)
+		}
+		return fmt.Sprintf("%02d:%02d:%02d", int(parts[0]), int(parts[1]), int(parts[2])), true
+	case (name == exif.GPSLatitude || name == exif.GPSLongitude) && tag.Count == 3:
+		d, okD := rational(tag, 0)
+		m, okM := rational(tag, 1)
+		s, okS := rational(tag, 2)
+		if !okD || !okM || !okS {
+			return nil, false
+		}
+		return d + m/60 + s/3600, true
+	}
+
+	switch tag.Format() {
+	case tiff.StringVal:
+		s, err := tag.StringVal()
+		s = strings.TrimRight(s, "\x00 ")
+		return s, err == nil && s != ""
+	case tiff.IntVal:
+		if tag.Count != 1 {
+			return nil, false
+		}
+		n, err := tag.Int64(0)
+		return float64(n), err == nil
+	case tiff.RatVal:
+		if tag.Count != 1 {
+			return nil, false
+		}
+		return rational(tag, 0)
+	case tiff.FloatVal:
+		if tag.Count != 1 {
+			return nil, false
+		}
+		f, err := tag.Float(0)
+		return f, err == nil
+	}
+	return nil, false
+}
+
+// rational returns value i of a rational tag. Cameras write 0/0 for values
+// they don't know, which aren't values at all.
+func rational(tag *tiff.Tag, i int) (float64, bool) {
+	n, d, err := tag.Rat2(i)
+	if err != nil || d == 0 {
+		return 0, false
+	}
+	return float64(n) / float64(d), true
+}
@@ -0,0 +1,67 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Cameras write 0/0 for rationals they don't know, which goexif can't turn
+// into a number
+func TestZeroRationals(t *testing.T) {
+	w := newTIFF(binary.LittleEndian, 42)
+	_, at := w.dir(
+		w.ascii(0x10f, "Canon"),
+		w.rational(0x11a, 0, 0), // XResolution
+		w.long(0x8769, 0),
+		w.long(0x8825, 0),
+	)
+	exifDir, _ := w.dir(
+		w.ascii(0x9003, "2020:02:02 10:10:10"),
+		w.rational(0xa404, 0, 0), // DigitalZoomRatio
+	)
+	gpsDir, _ := w.dir(
+		w.rational(0x2, 52, 1, 30, 1, 0, 0), // GPSLatitude
+		w.rational(0x6, 0, 0),               // GPSAltitude
+		w.rational(0x7, 10, 1, 0, 0, 5, 1),  // GPSTimeStamp
+	)
+	w.set(at[0x8769], exifDir)
+	w.set(at[0x8825], gpsDir)
+	path := writeFile(t, "zero.jpg", jpegFile(8, 8, w.bytes()))
+
+	fields, err := nativeReader{}.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"XResolution", "DigitalZoomRatio", "GPSLatitude", "GPSAltitude"} {
+		if value, ok := fields[tag]; ok {
+			t.Errorf("%s = %v, want no value", tag, value)
+		}
+	}
+	if got := fields.String("GPSTimeStamp"); got != "10:00:05" {
+		t.Errorf("GPSTimeStamp = %q, want %q", got, "10:00:05")
+	}
+	if got := fields.String("DateTimeOriginal"); got != "2020:02:02 10:10:10" {
+		t.Errorf("DateTimeOriginal = %q, want %q", got, "2020:02:02 10:10:10")
+	}
+}
+
+// goexif sizes the values of a tag by its count, which overflows into a few
+// bytes for a count of a billion longs and then allocates gigabytes
+func TestHugeTagCount(t *testing.T) {
+	w := newTIFF(binary.LittleEndian, 42)
+	w.dir(w.ascii(0x10f, "Canon"), entry{0x110, 4, 1<<30 + 1, []byte{1, 2, 3, 4}})
+	if err := checkTIFF(w.bytes()); err == nil {
+		t.Error("checkTIFF passed a tag with a billion values")
+	}
+
+	fields, err := nativeReader{}.Read(writeFile(t, "huge.jpg", jpegFile(8, 8, w.bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fields.String("Make"); got != "" {
+		t.Errorf("Make = %q from a corrupt EXIF block", got)
+	}
+	if _, err := (nativeReader{}).Read(writeFile(t, "huge.tif", w.bytes())); err == nil {
+		t.Error("Read of a corrupt TIFF file succeeded")
+	}
+}
@@ -0,0 +1,29 @@
+package metadata
+
+import (
+	"fmt"
+
+	exiftool "github.com/barasher/go-exiftool"
+)
+
+// exiftoolReader reads metadata with the exiftool program
+type exiftoolReader struct{}
+
+func (exiftoolReader) Read(path string) (Fields, error) {
+	et, err := exiftool.NewExiftool()
+	if err != nil {
+		return nil, fmt.Errorf("Error when creating Exiftool: %v", err)
+	}
+	defer et.Close()
+
+	fileInfos := et.ExtractMetadata(path)
+	if len(fileInfos) == 0 {
+		return nil, fmt.Errorf("No metadata extracted for file: %s", path)
+	}
+
+	fi := fileInfos[0]
+	if fi.Err != nil {
+		return nil, fi.Err
+	}
+	return Fields(fi.Fields), nil
+}
@@ -0,0 +1,213 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// The tests build their files in code. They hold little more than the tags
+// the readers look at, which keeps them small and shows what each one tests.
+
+// entry is a tag of a TIFF directory with its raw value
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// tiffWriter builds a TIFF file one directory at a time
+type tiffWriter struct {
+	order binary.ByteOrder
+	buf   bytes.Buffer
+}
+
+// newTIFF starts a TIFF file with the given magic number, whose first
+// directory is written next
+func newTIFF(order binary.ByteOrder, magic uint16) *tiffWriter {
+	w := &tiffWriter{order: order}
+	if order == binary.LittleEndian {
+		w.buf.WriteString("II")
+	} else {
+		w.buf.WriteString("MM")
+	}
+	binary.Write(&w.buf, order, magic)
+	binary.Write(&w.buf, order, uint32(8))
+	return w
+}
+
+func (w *tiffWriter) ascii(tag uint16, s string) entry {
+	data := append([]byte(s), 0)
+	return entry{tag, 2, uint32(len(data)), data}
+}
+
+func (w *tiffWriter) short(tag uint16, v uint16) entry {
+	data := make([]byte, 2)
+	w.order.PutUint16(data, v)
+	return entry{tag, 3, 1, data}
+}
+
+func (w *tiffWriter) long(tag uint16, v uint32) entry {
+	data := make([]byte, 4)
+	w.order.PutUint32(data, v)
+	return entry{tag, 4, 1, data}
+}
+
+func (w *tiffWriter) rational(tag uint16, values ...uint32) entry {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		w.order.PutUint32(data[4*i:], v)
+	}
+	return entry{tag, 5, uint32(len(values) / 2), data}
+}
+
+func (w *tiffWriter) undefined(tag uint16, data []byte) entry {
+	return entry{tag, 7, uint32(len(data)), data}
+}
+
+// dir writes a directory with its values behind it and returns its offset and
+// where the value of each tag is, so pointers can be filled in later
+func (w *tiffWriter) dir(entries ...entry) (uint32, map[uint16]int) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	start := uint32(w.buf.Len())
+	valueAt := start + 2 + uint32(len(entries))*12 + 4
+	var values bytes.Buffer
+	at := make(map[uint16]int)
+	binary.Write(&w.buf, w.order, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(&w.buf, w.order, e.tag)
+		binary.Write(&w.buf, w.order, e.typ)
+		binary.Write(&w.buf, w.order, e.count)
+		at[e.tag] = w.buf.Len()
+		if len(e.data) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, e.data)
+			w.buf.Write(inline)
+			continue
+		}
+		binary.Write(&w.buf, w.order, valueAt+uint32(values.Len()))
+		values.Write(e.data)
+		if values.Len()%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(&w.buf, w.order, uint32(0))
+	w.buf.Write(values.Bytes())
+	return start, at
+}
+
+// set overwrites the 32 bit value at
+func (w *tiffWriter) set(at int, v uint32) {
+	w.order.PutUint32(w.buf.Bytes()[at:], v)
+}
+
+// link makes the directory at next follow the one at dir
+func (w *tiffWriter) link(dir, next uint32) {
+	n := w.order.Uint16(w.buf.Bytes()[dir:])
+	w.set(int(dir)+2+int(n)*12, next)
+}
+
+// write appends data and returns its offset
+func (w *tiffWriter) write(data []byte) uint32 {
+	offset := uint32(w.buf.Len())
+	w.buf.Write(data)
+	return offset
+}
+
+func (w *tiffWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// exifBlock returns a TIFF block with the given make and model in the first
+// directory and the date and its offset in an EXIF directory
+func exifBlock(order binary.ByteOrder, cameraMake, model, date, offset string) []byte {
+	w := newTIFF(order, 42)
+	_, at := w.dir(w.ascii(0x10f, cameraMake), w.ascii(0x110, model), w.long(0x8769, 0))
+	exifDir, _ := w.dir(w.ascii(0x9003, date), w.ascii(0x9011, offset))
+	w.set(at[0x8769], exifDir)
+	return w.bytes()
+}
+
+// jpegFile returns a gray JPEG of the given size with exif, if any, in an
+// APP1 segment
+func jpegFile(width, height int, exif []byte) []byte {
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, width, height)), nil)
+	data := encoded.Bytes()
+	if exif == nil {
+		return data
+	}
+	app1 := append([]byte("Exif\x00\x00"), exif...)
+	segment := []byte{0xff, 0xe1, byte((len(app1) + 2) >> 8), byte(len(app1) + 2)}
+	return bytes.Join([][]byte{{0xff, 0xd8}, segment, app1, data[2:]}, nil)
+}
+
+// writeFile writes data to a temporary file named name and returns its path
+func writeFile(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// bmffBox returns a box of type typ holding parts one after the other
+func bmffBox(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	data := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(data, typ...), body...)
+}
+
+// heicFile returns a HEIF image with a thumbnail and a full size image extent,
+// and exif in an item stored in the mdat box
+func heicFile(width, height uint32, exif []byte) []byte {
+	ftyp := bmffBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	item := append([]byte("\x00\x00\x00\x06Exif\x00\x00"), exif...)
+	meta := func(offset uint32) []byte {
+		iloc := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 1, 0, 0, 0, 1}
+		iloc = binary.BigEndian.AppendUint32(iloc, offset)
+		iloc = binary.BigEndian.AppendUint32(iloc, uint32(len(item)))
+		return bmffBox("meta", []byte{0, 0, 0, 0},
+			bmffBox("hdlr", make([]byte, 8), []byte("pict"), make([]byte, 13)),
+			bmffBox("iinf", []byte{0, 0, 0, 0, 0, 1}, bmffBox("infe", []byte{2, 0, 0, 0, 0, 1, 0, 0}, []byte("Exif\x00"))),
+			bmffBox("iloc", iloc),
+			bmffBox("iprp", bmffBox("ipco", ispe(320, 240), ispe(width, height))),
+		)
+	}
+	offset := uint32(len(ftyp) + len(meta(0)) + 8)
+	return bytes.Join([][]byte{ftyp, meta(offset), bmffBox("mdat", item)}, nil)
+}
+
+// ispe returns the image spatial extent property of a HEIF image
+func ispe(width, height uint32) []byte {
+	data := binary.BigEndian.AppendUint32(make([]byte, 4), width)
+	return bmffBox("ispe", binary.BigEndian.AppendUint32(data, height))
+}
+
+// cr3File returns a CR3 file with the TIFF blocks of its first directory and
+// its EXIF directory, and preview in a PRVW box
+func cr3File(ifd0, exifDir, preview []byte) []byte {
+	prvw := binary.BigEndian.AppendUint32(make([]byte, 12), uint32(len(preview)))
+	return bytes.Join([][]byte{
+		bmffBox("ftyp", []byte("crx \x00\x00\x00\x01crx isom")),
+		bmffBox("moov", bmffBox("uuid", []byte(canonUUID), bmffBox("CMT1", ifd0), bmffBox("CMT2", exifDir))),
+		bmffBox("uuid", []byte(previewUUID), make([]byte, 8), bmffBox("PRVW", prvw, preview)),
+		bmffBox("mdat"),
+	}, nil)
+}
+
+// rafFile returns a RAF file whose JPEG follows the header
+func rafFile(jpeg []byte) []byte {
+	header := make([]byte, 100)
+	copy(header, rafMagic+"0201FF383501")
+	binary.BigEndian.PutUint32(header[84:], uint32(len(header)))
+	binary.BigEndian.PutUint32(header[88:], uint32(len(jpeg)))
+	return append(header, jpeg...)
+}
@@ -0,0 +1,103 @@
+// Package metadata reads the metadata tags of photos and videos, either with
+// its own Go readers or with ExifTool, shared by movephoto and the dedupe tool.
+// Tags are named and formatted the way ExifTool names and formats them.
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Backends that read metadata
+const (
+	Native   = "native"   // The Go readers, for JPEG, TIFF, HEIC/HEIF, MP4/QuickTime and camera RAW files
+	ExifTool = "exiftool" // The exiftool program, which needs Perl but reads almost anything
+	Auto     = "auto"     // The Go readers, and ExifTool for other formats if it is installed
+)
+
+// ErrUnsupported is returned by the Go readers for formats they can't read
+var ErrUnsupported = errors.New("unsupported file format")
+
+// ErrCorrupt is returned for files whose metadata crashed the reader
+var ErrCorrupt = errors.New("corrupt metadata")
+
+// recoverCorrupt turns a panic while reading the file at path into an
+// ErrCorrupt error in *err, so that one broken file doesn't stop the program
+func recoverCorrupt(path string, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%s: %w: %v", path, ErrCorrupt, r)
+	}
+}
+
+// Fields are the metadata tags of a file by their ExifTool names. Values are
+// strings or float64 numbers.
+type Fields map[string]interface{}
+
+// String returns the first of tags that is set as a string
+func (f Fields) String(tags ...string) string {
+	for _, tag := range tags {
+		if value, ok := f[tag]; ok {
+			if s := strings.TrimSpace(fmt.Sprint(value)); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// Number returns the first of tags that holds a number, 0 if none does
+func (f Fields) Number(tags ...string) float64 {
+	for _, tag := range tags {
+		switch value := f[tag].(type) {
+		case float64:
+			return value
+		case string:
+			if n, err := strconv.ParseFloat(strings.Fields(value + " x")[0], 64); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// Reader reads the metadata of a file
+type Reader interface {
+	Read(path string) (Fields, error)
+}
+
+// New returns the reader of backend
+func New(backend string) (Reader, error) {
+	switch backend {
+	case Native:
+		return nativeReader{}, nil
+	case ExifTool:
+		if _, err := exec.LookPath("exiftool"); err != nil {
+			return nil, fmt.Errorf("metadata backend exiftool needs the exiftool program: %v", err)
+		}
+		return exiftoolReader{}, nil
+	case Auto, "":
+		reader := autoReader{}
+		if _, err := exec.LookPath("exiftool"); err == nil {
+			reader.fallback = exiftoolReader{}
+		}
+		return reader, nil
+	}
+	return nil, fmt.Errorf("unknown metadata backend %q, expected %s, %s or %s", backend, Native, ExifTool, Auto)
+}
+
+// autoReader reads files with the Go readers and falls back to ExifTool, if
+// installed, for formats they don't support
+type autoReader struct {
+	fallback Reader // Nil without ExifTool
+}
+
+func (r autoReader) Read(path string) (Fields, error) {
+	fields, err := nativeReader{}.Read(path)
+	if errors.Is(err, ErrUnsupported) && r.fallback != nil {
+		return r.fallback.Read(path)
+	}
+	return fields, err
+}
@@ -0,0 +1,68 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	// Decoders for the dimensions of images without EXIF data
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// nativeReader reads metadata with the Go readers of this package
+type nativeReader struct{}
+
+func (nativeReader) Read(path string) (_ Fields, err error) {
+	defer recoverCorrupt(path, &err)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 16)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+	fields := Fields{}
+	switch {
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8}):
+		readImageSize(file, fields)
+		file.Seek(0, io.SeekStart)
+		data, _ := io.ReadAll(io.LimitReader(file, maxExifSize))
+		readExif(data, fields) // A JPEG without EXIF data just has no tags
+	case isTIFF(header):
+		if err := readTIFF(file, info.Size(), fields); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(header, []byte(rafMagic)):
+		if err := readRAF(file, info.Size(), fields); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(header, []byte("\x89PNG")), bytes.HasPrefix(header, []byte("GIF8")):
+		readImageSize(file, fields)
+	case isBMFF(header):
+		if err := readBMFF(file, info.Size(), fields); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: %w", path, ErrUnsupported)
+	}
+	return fields, nil
+}
+
+// readImageSize sets the dimensions of an image in fields
+func readImageSize(file io.ReadSeeker, fields Fields) {
+	file.Seek(0, io.SeekStart)
+	if config, _, err := image.DecodeConfig(file); err == nil {
+		fields["ImageWidth"] = float64(config.Width)
+		fields["ImageHeight"] = float64(config.Height)
+	}
+}
@@ -0,0 +1,190 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// tiffRaw returns a TIFF based RAW file like a NEF or a DNG: a thumbnail in
+// the first directory, the EXIF directory, and sub-directories with preview
+// and with the sensor data at the given size
+func tiffRaw(order binary.ByteOrder, cameraMake, model, date string, preview []byte, width, height uint32) []byte {
+	w := newTIFF(order, 42)
+	_, at := w.dir(
+		w.long(0xfe, 1), // NewSubFileType: reduced resolution
+		w.long(0x100, 160),
+		w.long(0x101, 120),
+		w.ascii(0x10f, cameraMake),
+		w.ascii(0x110, model),
+		entry{0x14a, 4, 2, make([]byte, 8)}, // SubIFDs
+		w.long(0x8769, 0),
+	)
+	exifDir, _ := w.dir(w.ascii(0x9003, date))
+	previewDir, previewAt := w.dir(
+		w.long(0xfe, 1),
+		w.long(0x201, 0), // JPEGInterchangeFormat
+		w.long(0x202, uint32(len(preview))),
+	)
+	rawDir, _ := w.dir(
+		w.long(0xfe, 0), // NewSubFileType: full resolution
+		w.long(0x100, width),
+		w.long(0x101, height),
+	)
+	w.set(at[0x8769], exifDir)
+	pointers := make([]byte, 8)
+	order.PutUint32(pointers, previewDir)
+	order.PutUint32(pointers[4:], rawDir)
+	w.set(at[0x14a], w.write(pointers))
+	w.set(previewAt[0x201], w.write(preview))
+	return w.bytes()
+}
+
+// cr3Blocks returns the TIFF blocks of the first and the EXIF directory of a
+// CR3 file
+func cr3Blocks(cameraMake, model, date string) ([]byte, []byte) {
+	ifd0 := newTIFF(binary.LittleEndian, 42)
+	ifd0.dir(ifd0.ascii(0x10f, cameraMake), ifd0.ascii(0x110, model))
+	exifDir := newTIFF(binary.LittleEndian, 42)
+	exifDir.dir(exifDir.ascii(0x9003, date), exifDir.ascii(0x9011, "+01:00"))
+	return ifd0.bytes(), exifDir.bytes()
+}
+
+// nativeFixture is a file with the tags and the preview the native reader
+// should find in it
+type nativeFixture struct {
+	name          string
+	data          []byte
+	tags          map[string]string
+	width, height float64
+	preview       []byte
+}
+
+func nativeFixtures() []nativeFixture {
+	preview := jpegFile(160, 120, nil)
+	ifd0, exifDir := cr3Blocks("Canon", "Canon EOS R5", "2022:03:04 05:06:07")
+	return []nativeFixture{
+		{
+			name: "photo.jpg",
+			data: jpegFile(64, 48, exifBlock(binary.LittleEndian, "Apple", "iPhone 12", "2021:06:07 08:09:10", "+02:00")),
+			tags: map[string]string{
+				"Make":               "Apple",
+				"Model":              "iPhone 12",
+				"DateTimeOriginal":   "2021:06:07 08:09:10",
+				"OffsetTimeOriginal": "+02:00",
+			},
+			width:  64,
+			height: 48,
+		},
+		{
+			name: "photo.heic",
+			data: heicFile(4032, 3024, exifBlock(binary.BigEndian, "Apple", "iPhone 15", "2023:01:02 03:04:05", "-05:00")),
+			tags: map[string]string{
+				"Make":               "Apple",
+				"Model":              "iPhone 15",
+				"DateTimeOriginal":   "2023:01:02 03:04:05",
+				"OffsetTimeOriginal": "-05:00",
+			},
+			width:  4032,
+			height: 3024,
+		},
+		{
+			name: "photo.cr3",
+			data: cr3File(ifd0, exifDir, preview),
+			tags: map[string]string{
+				"Make":               "Canon",
+				"Model":              "Canon EOS R5",
+				"DateTimeOriginal":   "2022:03:04 05:06:07",
+				"OffsetTimeOriginal": "+01:00",
+			},
+			preview: preview,
+		},
+		{
+			name: "photo.nef",
+			data: tiffRaw(binary.LittleEndian, "NIKON CORPORATION", "NIKON Z 6", "2019:10:11 12:13:14", preview, 6048, 4024),
+			tags: map[string]string{
+				"Make":             "NIKON CORPORATION",
+				"Model":            "NIKON Z 6",
+				"DateTimeOriginal": "2019:10:11 12:13:14",
+			},
+			width:   6048,
+			height:  4024,
+			preview: preview,
+		},
+		{
+			name: "photo.dng",
+			data: tiffRaw(binary.BigEndian, "Leica Camera AG", "LEICA Q2", "2020:11:12 13:14:15", preview, 8368, 5584),
+			tags: map[string]string{
+				"Make":             "Leica Camera AG",
+				"Model":            "LEICA Q2",
+				"DateTimeOriginal": "2020:11:12 13:14:15",
+			},
+			width:   8368,
+			height:  5584,
+			preview: preview,
+		},
+		{
+			name: "photo.raf",
+			data: rafFile(jpegFile(160, 120, exifBlock(binary.BigEndian, "FUJIFILM", "X-T4", "2018:07:08 09:10:11", "+09:00"))),
+			tags: map[string]string{
+				"Make":               "FUJIFILM",
+				"Model":              "X-T4",
+				"DateTimeOriginal":   "2018:07:08 09:10:11",
+				"OffsetTimeOriginal": "+09:00",
+			},
+			preview: jpegFile(160, 120, exifBlock(binary.BigEndian, "FUJIFILM", "X-T4", "2018:07:08 09:10:11", "+09:00")),
+		},
+	}
+}
+
+func TestNativeRead(t *testing.T) {
+	for _, fixture := range nativeFixtures() {
+		t.Run(fixture.name, func(t *testing.T) {
+			path := writeFile(t, fixture.name, fixture.data)
+			fields, err := nativeReader{}.Read(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for tag, want := range fixture.tags {
+				if got := fields.String(tag); got != want {
+					t.Errorf("%s = %q, want %q", tag, got, want)
+				}
+			}
+			if fixture.width > 0 {
+				if width, height := fields.Number("ImageWidth"), fields.Number("ImageHeight"); width != fixture.width || height != fixture.height {
+					t.Errorf("size = %vx%v, want %vx%v", width, height, fixture.width, fixture.height)
+				}
+			}
+
+			preview, err := Preview(path)
+			switch {
+			case fixture.preview == nil && err == nil:
+				t.Errorf("Preview returned %d bytes for a file without one", len(preview))
+			case fixture.preview != nil && err != nil:
+				t.Errorf("Preview: %v", err)
+			case !bytes.Equal(preview, fixture.preview):
+				t.Errorf("Preview returned %d bytes, want the %d of the embedded JPEG", len(preview), len(fixture.preview))
+			}
+		})
+	}
+}
+
+// FuzzRead makes sure that no file, however broken, crashes the readers. They
+// recover from panics, which the fuzzer would not see, so it calls the
+// readers of each format directly.
+func FuzzRead(f *testing.F) {
+	for _, fixture := range nativeFixtures() {
+		f.Add(fixture.data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		size := int64(len(data))
+		readExif(data, Fields{})
+		readTIFF(r, size, Fields{})
+		readRAF(r, size, Fields{})
+		readBMFF(r, size, Fields{})
+		tiffPreview(r, size)
+		rafPreview(r, size)
+		cr3Preview(r, readBoxes(r, 0, size))
+	})
+}
@@ -0,0 +1,363 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// Camera RAW files are TIFF files with a few quirks (CR2, NEF, ARW, DNG, ORF,
+// RW2), ISO base media files (CR3) or a JPEG with the EXIF data in front of
+// the sensor data (RAF). All of them carry a JPEG preview.
+
+// ErrNoPreview is returned by Preview for files without a JPEG preview
+var ErrNoPreview = errors.New("no preview found")
+
+// tiffPrefix is how much of a TIFF based file is read for its directories,
+// which usually come before the image data. Files laid out otherwise are read
+// whole, with checkTIFF keeping the tags within the file.
+const tiffPrefix = maxExifSize
+
+// maxPreviewSize limits the previews read from RAW files
+const maxPreviewSize = 64 << 20
+
+// rafMagic starts Fujifilm RAF files
+const rafMagic = "FUJIFILMCCD-RAW "
+
+// The UUID boxes of CR3 files with the EXIF data and the preview
+const (
+	canonUUID   = "\x85\xc0\xb6\x87\x82\x0f\x11\xe0\x81\x11\xf4\xce\x46\x2b\x6a\x48"
+	previewUUID = "\xea\xf4\x2b\x5e\x1c\x98\x4b\x88\xb9\xfb\xb2\xb4\xc8\xa1\xb7\xdd"
+)
+
+// isTIFF reports whether header starts a TIFF file, including the Olympus
+// (ORF) and Panasonic (RW2) variants with their own magic number
+func isTIFF(header []byte) bool {
+	if len(header) < 4 {
+		return false
+	}
+	switch string(header[:4]) {
+	case "II*\x00", "MM\x00*", "IIRO", "IIRS", "MMOR", "IIU\x00":
+		return true
+	}
+	return false
+}
+
+// tiffData reads the first limit bytes of a TIFF file with the magic number
+// set to the standard 42, which goexif insists on
+func tiffData(r io.ReaderAt, size, limit int64) []byte {
+	if size > limit {
+		size = limit
+	}
+	data := make([]byte, size)
+	n, _ := r.ReadAt(data, 0)
+	data = data[:n]
+	if len(data) >= 4 {
+		if data[0] == 'I' {
+			data[2], data[3] = 42, 0
+		} else {
+			data[2], data[3] = 0, 42
+		}
+	}
+	return data
+}
+
+// readTIFF reads the EXIF tags of a TIFF image or TIFF based RAW file. RW2
+// files keep some of them only in their preview, so tags missing from the
+// file itself are taken from there.
+func readTIFF(r io.ReaderAt, size int64, fields Fields) error {
+	data := tiffData(r, size, tiffPrefix)
+	err := readExif(data, fields)
+	if err != nil && size > tiffPrefix {
+		data = tiffData(r, size, size)
+		err = readExif(data, fields)
+	}
+	if err != nil {
+		return err
+	}
+	if dirs, err := tiffDirs(data); err == nil {
+		readFullSize(dirs, fields)
+	}
+	if fields.String("DateTimeOriginal") == "" {
+		if preview, err := tiffPreview(r, size); err == nil {
+			previewFields := Fields{}
+			readExif(preview, previewFields)
+			for tag, value := range previewFields {
+				if _, ok := fields[tag]; !ok {
+					fields[tag] = value
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readRAF reads the EXIF tags of a Fujifilm RAF file from its JPEG
+func readRAF(r io.ReaderAt, size int64, fields Fields) error {
+	preview, err := rafPreview(r, size)
+	if err != nil {
+		return err
+	}
+	return readExif(preview, fields)
+}
+
+// readCR3 reads the EXIF tags of a Canon CR3 file, which keeps the first
+// directory and the EXIF directory in boxes of their own
+func readCR3(r io.ReaderAt, top []box, fields Fields) error {
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return fmt.Errorf("no movie header found")
+	}
+	canon, ok := findUUID(r, children(r, moov, 0), canonUUID)
+	if !ok {
+		return fmt.Errorf("no Canon metadata found")
+	}
+	boxes := children(r, canon, 16)
+	for _, typ := range []string{"CMT1", "CMT2"} {
+		if b, ok := findBox(boxes, typ); ok {
+			readExif(payload(r, b, maxItemSize), fields)
+		}
+	}
+	return nil
+}
+
+// findUUID returns the first of boxes that is a uuid box of type uuid
+func findUUID(r io.ReaderAt, boxes []box, uuid string) (box, bool) {
+	for _, b := range boxes {
+		if b.typ == "uuid" && string(payload(r, b, 16)) == uuid {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+// Preview returns the JPEG preview embedded in a RAW file, the largest one
+// if there are several
+func Preview(path string) (_ []byte, err error) {
+	defer recoverCorrupt(path, &err)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 16)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte(rafMagic)):
+		return rafPreview(file, info.Size())
+	case isTIFF(header):
+		return tiffPreview(file, info.Size())
+	case isBMFF(header):
+		return cr3Preview(file, readBoxes(file, 0, info.Size()))
+	}
+	return nil, fmt.Errorf("%s: %w", path, ErrUnsupported)
+}
+
+// rafPreview returns the JPEG of a RAF file, whose offset and length follow
+// the header
+func rafPreview(r io.ReaderAt, size int64) ([]byte, error) {
+	var pointer [8]byte
+	if _, err := r.ReadAt(pointer[:], 84); err != nil {
+		return nil, err
+	}
+	return readJPEG(r, size, int64(binary.BigEndian.Uint32(pointer[:4])), int64(binary.BigEndian.Uint32(pointer[4:])))
+}
+
+// cr3Preview returns the preview of a CR3 file from its PRVW box
+func cr3Preview(r io.ReaderAt, top []box) ([]byte, error) {
+	uuid, ok := findUUID(r, top, previewUUID)
+	if !ok {
+		return nil, ErrNoPreview
+	}
+	// The PRVW box follows the UUID and 8 more bytes
+	prvw, ok := findBox(children(r, uuid, 24), "PRVW")
+	if !ok {
+		return nil, ErrNoPreview
+	}
+	// Dimensions and the length of the JPEG come before it
+	header := payload(r, prvw, 32)
+	start := bytes.Index(header, []byte{0xff, 0xd8, 0xff})
+	if start < 0 {
+		return nil, ErrNoPreview
+	}
+	return readJPEG(r, prvw.offset+prvw.size, prvw.offset+int64(start), prvw.size-int64(start))
+}
+
+// extent is a range of bytes in a file
+type extent struct {
+	offset, length int64
+}
+
+// tiffPreview returns the largest JPEG preview found in the directories and
+// sub-directories of a TIFF based RAW file: the JPEG of a directory, its strip
+// when that is a JPEG, or the JpgFromRaw tag of RW2 files
+func tiffPreview(r io.ReaderAt, size int64) ([]byte, error) {
+	dirs, err := tiffDirs(tiffData(r, size, tiffPrefix))
+	if err != nil && size > tiffPrefix {
+		dirs, err = tiffDirs(tiffData(r, size, size))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var best extent
+	for _, dir := range dirs {
+		tags := make(map[uint16]*tiff.Tag)
+		for _, tag := range dir.Tags {
+			tags[tag.Id] = tag
+		}
+		candidates := []extent{
+			tagExtent(tags, 0x201, 0x202), // JPEGInterchangeFormat and its length
+			tagExtent(tags, 0x111, 0x117), // StripOffsets and StripByteCounts
+		}
+		if tag, ok := tags[0x2e]; ok { // JpgFromRaw
+			candidates = append(candidates, extent{int64(tag.ValOffset), int64(len(tag.Val))})
+		}
+		for _, candidate := range candidates {
+			if candidate.length > best.length && isViewableJPEG(r, candidate) {
+				best = candidate
+			}
+		}
+	}
+	if best.length == 0 {
+		return nil, ErrNoPreview
+	}
+	return readJPEG(r, size, best.offset, best.length)
+}
+
+// tiffDirs decodes the directories of a TIFF block and their sub-directories,
+// which hold the full size images of RAW files
+func tiffDirs(data []byte) ([]*tiff.Dir, error) {
+	if err := checkTIFF(data); err != nil {
+		return nil, err
+	}
+	t, err := tiff.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := t.Dirs
+	for i := 0; i < len(dirs) && len(dirs) < 32; i++ {
+		for _, tag := range dirs[i].Tags {
+			if tag.Id != 0x14a { // SubIFDs
+				continue
+			}
+			for j := 0; j < int(tag.Count); j++ {
+				offset, err := tag.Int64(j)
+				if err != nil || offset <= 0 || offset >= int64(len(data)) {
+					continue
+				}
+				dirReader := bytes.NewReader(data)
+				dirReader.Seek(offset, io.SeekStart)
+				if dir, _, err := tiff.DecodeDir(dirReader, t.Order); err == nil {
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// readFullSize sets ImageWidth and ImageHeight to the largest image of dirs.
+// The first directory of most RAW files is a thumbnail, with the sensor data
+// or a full size preview in a later directory or a sub-directory.
+func readFullSize(dirs []*tiff.Dir, fields Fields) {
+	width, height := fields.Number("ImageWidth"), fields.Number("ImageHeight")
+	for _, dir := range dirs {
+		var w, h int64
+		for _, tag := range dir.Tags {
+			if tag.Count != 1 || tag.Format() != tiff.IntVal {
+				continue
+			}
+			switch tag.Id {
+			case 0x100: // ImageWidth
+				w, _ = tag.Int64(0)
+			case 0x101: // ImageLength
+				h, _ = tag.Int64(0)
+			}
+		}
+		if float64(w)*float64(h) > width*height {
+			width, height = float64(w), float64(h)
+		}
+	}
+	if width > 0 && height > 0 {
+		fields["ImageWidth"], fields["ImageHeight"] = width, height
+	}
+}
+
+// tagExtent returns the range given by an offset and a length tag, if the
+// directory has both with a single value
+func tagExtent(tags map[uint16]*tiff.Tag, offsetTag, lengthTag uint16) extent {
+	offset, length := tags[offsetTag], tags[lengthTag]
+	if offset == nil || length == nil || offset.Count != 1 || length.Count != 1 {
+		return extent{}
+	}
+	o, err := offset.Int64(0)
+	if err != nil {
+		return extent{}
+	}
+	l, err := length.Int64(0)
+	if err != nil {
+		return extent{}
+	}
+	return extent{o, l}
+}
+
+// isViewableJPEG reports whether e holds a JPEG an image viewer can show, as
+// opposed to the lossless JPEG some RAW formats keep the sensor data in
+func isViewableJPEG(r io.ReaderAt, e extent) bool {
+	if e.offset <= 0 || e.length < 4 {
+		return false
+	}
+	data := make([]byte, 256*1024)
+	n, _ := r.ReadAt(data, e.offset)
+	data = data[:n]
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return false
+	}
+	for at := 2; at+4 <= len(data); {
+		if data[at] != 0xff {
+			return false
+		}
+		marker := data[at+1]
+		switch {
+		case marker == 0xff: // Fill byte
+			at++
+			continue
+		case marker == 0xc0 || marker == 0xc1 || marker == 0xc2: // Baseline, extended or progressive
+			return true
+		case marker >= 0xc3 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return false // Lossless or arithmetic coding
+		case marker == 0xda: // Start of scan without a frame
+			return false
+		}
+		at += 2 + int(binary.BigEndian.Uint16(data[at+2:]))
+	}
+	return false
+}
+
+// readJPEG reads the JPEG at offset in a file of the given size
+func readJPEG(r io.ReaderAt, size, offset, length int64) ([]byte, error) {
+	if offset <= 0 || length < 4 || length > maxPreviewSize || offset+length > size {
+		return nil, ErrNoPreview
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	if data[0] != 0xff || data[1] != 0xd8 {
+		return nil, ErrNoPreview
+	}
+	return data, nil
+}
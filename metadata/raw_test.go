@@ -0,0 +1,33 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// The first directory of a DNG holds a thumbnail, the sensor data is in a
+// sub-directory
+func TestRawFullSize(t *testing.T) {
+	w := newTIFF(binary.LittleEndian, 42)
+	_, at := w.dir(
+		w.long(0xfe, 1), // NewSubFileType: reduced resolution
+		w.long(0x100, 256),
+		w.long(0x101, 171),
+		w.ascii(0x10f, "Canon"),
+		w.long(0x14a, 0),
+	)
+	sub, _ := w.dir(
+		w.long(0xfe, 0), // NewSubFileType: full resolution
+		w.long(0x100, 6000),
+		w.short(0x101, 4000),
+	)
+	w.set(at[0x14a], sub)
+
+	fields, err := nativeReader{}.Read(writeFile(t, "full.dng", w.bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width, height := fields.Number("ImageWidth"), fields.Number("ImageHeight"); width != 6000 || height != 4000 {
+		t.Errorf("size = %vx%v, want 6000x4000", width, height)
+	}
+}
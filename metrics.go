@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of the importer, served on metricsAddress in watch mode
+var (
+	filesScanned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "movephoto_files_scanned_total",
+		Help: "Files with an image or video extension found in a watch directory.",
+	}, []string{"watch_dir"})
+	filesImported = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "movephoto_files_imported_total",
+		Help: "Files imported, by watch directory and how they were transferred.",
+	}, []string{"watch_dir", "action"})
+	filesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "movephoto_files_skipped_total",
+		Help: "Files left alone, by watch directory and reason.",
+	}, []string{"watch_dir", "reason"})
+	filesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "movephoto_files_failed_total",
+		Help: "Files whose transfer failed, by watch directory and action.",
+	}, []string{"watch_dir", "action"})
+	bytesCopied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "movephoto_bytes_copied_total",
+		Help: "Bytes copied to a destination. Renames copy nothing.",
+	}, []string{"watch_dir"})
+	copyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "movephoto_copy_duration_seconds",
+		Help:    "Time to copy, sync and verify one file.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+	metadataReadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "movephoto_metadata_read_duration_seconds",
+		Help:    "Time to read the metadata of one file, with whichever backend read it.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	lastSuccessfulScan = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "movephoto_last_successful_scan_timestamp_seconds",
+		Help: "Unix time at which the last complete scan finished.",
+	})
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "movephoto_queue_depth",
+		Help: "Files whose destination is known and that are waiting for or in transfer.",
+	})
+	destinationCollisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "movephoto_destination_collisions_total",
+		Help: "Files not imported because their destination name was taken.",
+	}, []string{"watch_dir"})
+)
+
+// serveMetrics serves the metrics on address until the process exits
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	serve("metrics", address, mux)
+}
@@ -2,59 +2,179 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	exiftool "github.com/barasher/go-exiftool"
-	"gopkg.in/yaml.v2"
+	"github.com/cespare/xxhash/v2"
+	"gopkg.in/yaml.v3"
+	"lukechampine.com/blake3"
+	"movephoto/dates"
+	"movephoto/logging"
+	"movephoto/metadata"
 )
 
-// WatchDir represents a directory to watch along with the action to perform and optional prefixes
+// WatchDir represents a directory to watch along with the action to perform and optional prefixes.
+// The remaining fields optionally override the top-level settings for this directory only.
 type WatchDir struct {
-	Path          string   `yaml:"path"`
-	Action        string   `yaml:"action"`        // "move" or "copy"
-	IncludePrefix []string `yaml:"includePrefix"` // List of prefixes to include (optional)
+	Path                   string             `yaml:"path"`
+	Action                 string             `yaml:"action"`        // "move" or "copy"
+	IncludePrefix          []string           `yaml:"includePrefix"` // Deprecated, same as includePatterns ending in *
+	IncludePatterns        []string           `yaml:"includePatterns"`
+	ExcludePatterns        []string           `yaml:"excludePatterns"`
+	Destination            string             `yaml:"destination"`
+	DestinationTemplate    string             `yaml:"destinationTemplate"`
+	RawDestinationTemplate string             `yaml:"rawDestinationTemplate"`
+	ImageExtensions        []string           `yaml:"imageExtensions"`
+	VideoExtensions        []string           `yaml:"videoExtensions"`
+	RawExtensions          []string           `yaml:"rawExtensions"`
+	BannedExtensions       []string           `yaml:"bannedExtensions"`
+	MinFileSize            *int64             `yaml:"minFileSize"`
+	MaxFileSize            *int64             `yaml:"maxFileSize"`
+	Photos                 MediaLimits        `yaml:"photos"`
+	Videos                 MediaLimits        `yaml:"videos"`
+	UnknownDate            *UnknownDatePolicy `yaml:"unknownDate"` // Replaces the top-level policy as a whole
+}
+
+// UnmarshalYAML also accepts a bare path as a watch directory, which is
+// moved from like the original defaultWatchDir
+func (w *WatchDir) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*w = WatchDir{Path: value.Value, Action: "move"}
+		return nil
+	}
+	type plain WatchDir
+	return value.Decode((*plain)(w))
 }
 
 // Config holds the configuration data
 type Config struct {
-	WatchDirs             []WatchDir `yaml:"watchDirs"`
-	DefaultDestinationDir string     `yaml:"defaultDestinationDir"`
-	ImageExtensions       []string   `yaml:"imageExtensions"`
-	VideoExtensions       []string   `yaml:"videoExtensions"`
-	BannedExtensions      []string   `yaml:"bannedExtensions"`
-	LockFilePath          string     `yaml:"lockFilePath"`
+	WatchDirs              []WatchDir        `yaml:"watchDirs"`
+	DefaultDestinationDir  string            `yaml:"defaultDestinationDir"`
+	ImageExtensions        []string          `yaml:"imageExtensions"`
+	VideoExtensions        []string          `yaml:"videoExtensions"`
+	RawExtensions          []string          `yaml:"rawExtensions"` // Camera RAW files, dated like photos
+	BannedExtensions       []string          `yaml:"bannedExtensions"`
+	LockFilePath           string            `yaml:"lockFilePath"`
+	Preserve               Preserve          `yaml:"preserve"`
+	Verify                 string            `yaml:"verify"`        // "hash" (default), "size" or "none"
+	Checksum               string            `yaml:"checksum"`      // "sha256" (default), "blake3", "xxhash" or "md5"
+	MoveStrategy           string            `yaml:"moveStrategy"`  // "auto" (default) renames on the same filesystem, "copy" always copies
+	Workers                int               `yaml:"workers"`       // Files handled in parallel, defaults to the number of CPUs
+	DeviceWorkers          int               `yaml:"deviceWorkers"` // Concurrent transfers per destination device, defaults to 2
+	DestinationTemplate    string            `yaml:"destinationTemplate"`
+	RawDestinationTemplate string            `yaml:"rawDestinationTemplate"` // Layout for RAW files, defaults to destinationTemplate
+	RawPreviews            bool              `yaml:"rawPreviews"`            // Write the JPEG preview of each imported RAW file next to it
+	MinFileSize            *int64            `yaml:"minFileSize"`            // Bytes, defaults to 100KB
+	MaxFileSize            int64             `yaml:"maxFileSize"`            // Bytes, 0 means no limit
+	Rules                  []Rule            `yaml:"rules"`
+	QuarantineDir          string            `yaml:"quarantineDir"`   // Where rules with quarantine put files
+	IncludePatterns        []string          `yaml:"includePatterns"` // Globs, or regexes starting with "re:"
+	ExcludePatterns        []string          `yaml:"excludePatterns"`
+	Photos                 MediaLimits       `yaml:"photos"` // Limits for photos only, overriding minFileSize and maxFileSize
+	Videos                 MediaLimits       `yaml:"videos"`
+	MetricsAddress         string            `yaml:"metricsAddress"` // host:port or unix:/path for /metrics in watch mode, empty disables it
+	APIAddress             string            `yaml:"apiAddress"`     // host:port or unix:/path for the status and control API in watch mode
+	ReportsDir             string            `yaml:"reportsDir"`     // Where a JSON report of every scan is written, empty disables it
+	HTMLReports            bool              `yaml:"htmlReports"`    // Write an HTML report next to the JSON one
+	Hooks                  []Hook            `yaml:"hooks"`
+	Failures               FailurePolicy     `yaml:"failures"`    // Retries of files that can't be dated or transferred
+	UnknownDate            UnknownDatePolicy `yaml:"unknownDate"` // Dates or folder for files none of the date sources dates
+	DateSources            DateSources       `yaml:"dateSources"`
+	TimeShifts             []dates.TimeShift `yaml:"timeShifts"`      // Corrections of camera clocks, the first matching one applies
+	MetadataBackend        string            `yaml:"metadataBackend"` // "auto" (default), "native" or "exiftool"
+}
+
+// MediaLimits are the thresholds a photo or video must meet to be imported
+type MediaLimits struct {
+	MinFileSize  *int64         `yaml:"minFileSize"`
+	MaxFileSize  *int64         `yaml:"maxFileSize"`  // 0 means no limit
+	MinDimension *int           `yaml:"minDimension"` // Pixels of the shorter side, 0 means no limit
+	MinDuration  *time.Duration `yaml:"minDuration"`  // Videos only, 0 means no limit
+}
+
+// Preserve selects which attributes of the source file are carried over to the copy
+type Preserve struct {
+	Mtime                bool `yaml:"mtime"`
+	Atime                bool `yaml:"atime"`
+	Ownership            bool `yaml:"ownership"`            // Only honoured when running as root
+	Xattrs               bool `yaml:"xattrs"`               // Extended attributes such as user.* and Finder tags
+	MtimeFromCaptureTime bool `yaml:"mtimeFromCaptureTime"` // Set mtime to the capture time instead of the source mtime
+}
+
+// transferOptions controls how files are written to the destination
+type transferOptions struct {
+	Preserve      Preserve
+	Verify        string
+	Checksum      string
+	MoveStrategy  string
+	Workers       int
+	DeviceWorkers int
+}
+
+// newTransferOptions fills in the transfer defaults from the config
+func newTransferOptions(config Config) transferOptions {
+	opts := transferOptions{
+		Preserve:      config.Preserve,
+		Verify:        config.Verify,
+		Checksum:      config.Checksum,
+		MoveStrategy:  config.MoveStrategy,
+		Workers:       config.Workers,
+		DeviceWorkers: config.DeviceWorkers,
+	}
+	if opts.Verify == "" {
+		opts.Verify = "hash"
+	}
+	if opts.Checksum == "" {
+		opts.Checksum = "sha256"
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.DeviceWorkers <= 0 {
+		opts.DeviceWorkers = 2
+	}
+	if opts.MoveStrategy == "" {
+		opts.MoveStrategy = "auto"
+	}
+	return opts
 }
 
 // Global variable to keep track of processed files
 var processedFiles map[string]struct{}
 
+// processedFilesMu guards processedFiles and the processed files list, which
+// are updated from the import workers
+var processedFilesMu sync.Mutex
+
 // Path to the processed files list
 var processedFilesPath string
 
 func loadConfig() Config {
-	if _, err := os.Stat(*configFilePath); os.IsNotExist(err) {
+	// Without a config file everything comes from the environment and -set
+	if _, err := os.Stat(*configFilePath); *configFilePath != "" && os.IsNotExist(err) {
 		fmt.Printf("%s does not exist. Please create it and run the program again.\n", *configFilePath)
-		os.Exit(0)
+		os.Exit(1)
 	}
 
-	config := Config{}
-	data, err := os.ReadFile(*configFilePath)
-	if err != nil {
-		log.Fatalf("error: %v", err)
-	}
-	err = yaml.Unmarshal([]byte(data), &config)
+	config, err := readConfig(*configFilePath)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		logging.Fatal("Invalid configuration", "path", *configFilePath, logging.Err(err))
 	}
 	return config
 }
@@ -63,61 +183,109 @@ var (
 	pollingInterval = flag.Int("polling-interval", 30, "Polling interval in seconds for checking new files in the watch directories")
 	debug           = flag.Bool("debug", false, "Enable debug output")
 	watch           = flag.Bool("watch", false, "Enable regular scanning of the source directories")
-	configFilePath  = flag.String("config", "/etc/movephoto_config.yml", "Path to the configuration file")
-	minFileSize     = int64(102400) // Minimum file size in bytes (100KB)
+	configFilePath  = flag.String("config", "/etc/movephoto_config.yml", "Path to the configuration file, empty to configure only through MOVEPHOTO_* variables and -set")
+	lockTimeout     = flag.Duration("lock-timeout", 0, "How long to wait for another instance to release the lock file (0 fails immediately)")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long to let in-flight files finish after SIGTERM or SIGINT")
+	logOptions      = logging.AddFlags(flag.CommandLine)
 )
 
 func main() {
 	flag.Parse() // Parse the command-line flags
 
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "config":
+			os.Exit(runConfigCommand(flag.Args()[1:]))
+		case "failures":
+			os.Exit(runFailuresCommand(flag.Args()[1:]))
+		case "timeshift":
+			os.Exit(runTimeshiftCommand(flag.Args()[1:]))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+			os.Exit(2)
+		}
+	}
+
 	if *debug {
-		log.Printf("[%s] Debug mode enabled\n", currentTime())
+		logOptions.Level = "debug"
 	}
+	closeLog, err := logging.Setup(*logOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	slog.Debug("Debug mode enabled")
 
 	config := loadConfig()
 
-	// Add .heic to the list of image extensions
-	config.ImageExtensions = append(config.ImageExtensions, ".heic")
-
-	// Set the path for processed_files.txt under the destination directory
-	processedFilesPath = filepath.Join(config.DefaultDestinationDir, "processed_files.txt")
-
-	// Load processed files
-	processedFiles = loadProcessedFiles(processedFilesPath)
+	var lock *instanceLock
 
-	if !*watch {
-		if *debug {
-			log.Printf("[%s] Performing a single scan...\n", currentTime())
+	// Make sure no other instance, e.g. a cron run next to the service, works on the same files
+	if config.LockFilePath != "" {
+		var err error
+		lock, err = acquireLock(config.LockFilePath, *lockTimeout)
+		if err != nil {
+			logging.Fatal("Another instance is already running", logging.Err(err))
 		}
-		processFiles(config)
 	} else {
-		if *debug {
-			log.Printf("[%s] Starting regular scanning of source directories...\n", currentTime())
-		}
-		ticker := time.NewTicker(time.Duration(*pollingInterval) * time.Second)
-		defer ticker.Stop()
+		slog.Debug("No lockFilePath configured, not taking the instance lock")
+	}
 
-		for range ticker.C {
-			if *debug {
-				log.Printf("[%s] Polling for new files...\n", currentTime())
-			}
-			processFiles(config)
-		}
+	openState(config.DefaultDestinationDir)
+
+	// Remove temporary files left behind by a crash or power loss during a copy
+	openTempDirs(config.DefaultDestinationDir, destinationDirs(config))
+
+	code := run(config, *watch)
+
+	if lock != nil {
+		lock.release()
 	}
+	closeLog()
+	os.Exit(code)
 }
 
-func processFiles(config Config) {
+// processFiles runs one scan over all watch directories. Once ctx is cancelled
+// no new files are started; files already being transferred are finished.
+func processFiles(ctx context.Context, config Config) {
+	opts := newTransferOptions(config)
+	summary.Reset()
+	hooks.reset(config.Hooks)
+	useMetadataBackend(config.MetadataBackend)
+	failures.startScan(config.Failures)
+	status.startScan()
+	defer status.finishScan()
+	defer func() {
+		summary.Finish()
+		// Watch mode sees the same skipped files on every poll, only report scans that did something
+		eventful := !*watch || summary.Count("imported") > 0 || summary.Count("failed") > 0
+		reportScan(config, eventful)
+		hooks.finishScan(eventful)
+		if ctx.Err() == nil {
+			lastSuccessfulScan.SetToCurrentTime()
+		}
+	}()
 	for _, watchDir := range config.WatchDirs {
-		purge_unwanted(watchDir.Path, config.BannedExtensions)
-		switch watchDir.Action {
+		if ctx.Err() != nil {
+			return
+		}
+		if status.isPaused(watchDir.Path) {
+			slog.Debug("Skipping paused watch directory", "dir", watchDir.Path)
+			continue
+		}
+		settings := resolveWatchDir(config, watchDir)
+		purge_unwanted(settings.Path, settings.BannedExtensions)
+		switch settings.Action {
 		case "move":
-			move_photos(watchDir.Path, config.DefaultDestinationDir, config.ImageExtensions)
-			move_videos(watchDir.Path, config.DefaultDestinationDir, config.VideoExtensions)
+			move_photos(ctx, settings, opts)
+			move_raws(ctx, settings, opts)
+			move_videos(ctx, settings, opts)
 		case "copy":
-			copy_photos(watchDir.Path, config.DefaultDestinationDir, config.ImageExtensions, watchDir.IncludePrefix)
-			copy_videos(watchDir.Path, config.DefaultDestinationDir, config.VideoExtensions, watchDir.IncludePrefix)
+			copy_photos(ctx, settings, opts)
+			copy_raws(ctx, settings, opts)
+			copy_videos(ctx, settings, opts)
 		default:
-			log.Printf("Unknown action %s for watch directory %s", watchDir.Action, watchDir.Path)
+			slog.Error("Unknown action for watch directory", "action", watchDir.Action, "dir", watchDir.Path)
 		}
 	}
 
@@ -140,69 +308,79 @@ func purge_unwanted(watch_dir string, banned_extensions []string) error {
 	return nil
 }
 
-func move_files(watch_dir string, destination_dir string, extensions []string, get_destination_dir func(filePath string, file os.FileInfo) (string, bool)) error {
-	files, err := os.ReadDir(watch_dir)
+func move_files(ctx context.Context, settings watchSettings, extensions []string, limits mediaLimits, opts transferOptions, get_destination_dir func(filePath string, file os.FileInfo) route) error {
+	candidates, err := scanCandidates(settings, extensions, limits, false)
 	if err != nil {
 		return err
 	}
 
-	for _, entry := range files {
-		info, err := entry.Info()
-		if err != nil {
-			continue // Skip if we can't get file info
-		}
-
-		if !info.Mode().IsRegular() {
-			continue // Skip non-regular files
-		}
-
-		if !hasExtension(info.Name(), extensions) {
-			continue
-		}
+	resolveDestinations(ctx, candidates, opts.Workers, settings.Action == "move", get_destination_dir)
+	claimed := claimDestinations(candidates)
+	defer releaseDestinations(claimed)
 
-		// Skip files smaller than the minimum size
-		if info.Size() < minFileSize {
-			if *debug {
-				log.Printf("[%s] Skipping file (too small): %s\n", currentTime(), info.Name())
-			}
-			continue
-		}
-
-		sourcePath := filepath.Join(watch_dir, info.Name())
-		full_destination_dir, shouldProcess := get_destination_dir(sourcePath, info)
-		if !shouldProcess {
-			log.Printf("[%s] Skipping file: %s (no valid date found)\n", currentTime(), sourcePath)
-			continue
-		}
-
-		full_destination := filepath.Join(full_destination_dir, info.Name())
+	transferAll(ctx, claimed, opts, func(c *candidate) {
+		start := time.Now()
+		sourcePath, full_destination_dir, full_destination := c.path, c.route.dir, c.fullDestination
 		if _, err := os.Stat(full_destination_dir); os.IsNotExist(err) {
 			os.MkdirAll(full_destination_dir, os.ModePerm)
 		}
-		if _, err := os.Stat(full_destination); os.IsNotExist(err) {
-			err := copyAndVerify(sourcePath, full_destination)
+		if _, err := os.Stat(full_destination); !os.IsNotExist(err) {
+			countCollision(sourcePath, "destination exists", full_destination)
+			return
+		}
+
+		// Within one filesystem a rename is instant and atomic, no copy needed
+		if opts.MoveStrategy == "auto" && sameDevice(sourcePath, full_destination_dir) {
+			err := renameNoClobber(sourcePath, full_destination, opts, c.route.dateTaken)
 			if err != nil {
-				log.Printf("[%s] Failed to move file: %s\n", currentTime(), err)
+				slog.Error("Failed to move file", "source", sourcePath, "destination", full_destination, "action", "rename", logging.Err(err))
+				countFailed(sourcePath, full_destination, "rename", true, err)
 			} else {
-				// Delete the source file after successful copy and verification
-				err = os.Remove(sourcePath)
-				if err != nil {
-					log.Printf("[%s] Failed to delete source file: %s\n", currentTime(), err)
-				} else {
-					log.Printf("[%s] Moved file: %s to %s\n", currentTime(), sourcePath, full_destination)
-				}
+				tagFile(full_destination, c.route)
+				preview := writePreview(full_destination, c.route)
+				record := importRecord{Source: sourcePath, Destination: full_destination, Size: c.info.Size(), Tags: c.route.tags, Rule: c.route.rule, DateSource: c.route.dateSource, TimeShift: c.route.timeShift, Preview: preview}
+				state.recordImport(record)
+				countImported(record, "rename", 0)
+				slog.Info("Moved file", "source", sourcePath, "destination", full_destination, "action", "rename", "duration", time.Since(start))
 			}
+			return
 		}
-	}
+
+		checksum, err := copyAndVerify(sourcePath, full_destination, opts, c.route.dateTaken)
+		if err != nil {
+			slog.Error("Failed to move file", "source", sourcePath, "destination", full_destination, "action", "move", logging.Err(err))
+			countFailed(sourcePath, full_destination, "move", true, err)
+			return
+		}
+		tagFile(full_destination, c.route)
+		preview := writePreview(full_destination, c.route)
+		record := importRecord{Source: sourcePath, Destination: full_destination, Size: c.info.Size(), Algorithm: opts.Checksum, Checksum: checksum, Tags: c.route.tags, Rule: c.route.rule, DateSource: c.route.dateSource, TimeShift: c.route.timeShift, Preview: preview}
+		state.recordImport(record)
+		countImported(record, "move", c.info.Size())
+
+		// Delete the source file after successful copy and verification
+		err = os.Remove(sourcePath)
+		if err != nil {
+			slog.Error("Failed to delete source file", "source", sourcePath, logging.Err(err))
+		} else {
+			slog.Info("Moved file", "source", sourcePath, "destination", full_destination, "action", "move", "hash", checksum, "duration", time.Since(start))
+		}
+	})
 	return nil
 }
 
-func copy_files(watch_dir string, destination_dir string, extensions []string, includePrefix []string, get_destination_dir func(filePath string, file os.FileInfo) (string, bool)) error {
+// scanCandidates lists the files of the watch directory of settings with one
+// of extensions, skipping and counting those the filter or the size limits
+// leave out. skipProcessed leaves out the files a copy watch directory has
+// already imported.
+func scanCandidates(settings watchSettings, extensions []string, limits mediaLimits, skipProcessed bool) ([]*candidate, error) {
+	watch_dir := settings.Path
 	files, err := os.ReadDir(watch_dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var candidates []*candidate
 	for _, entry := range files {
 		info, err := entry.Info()
 		if err != nil {
@@ -216,398 +394,541 @@ func copy_files(watch_dir string, destination_dir string, extensions []string, i
 		if !hasExtension(info.Name(), extensions) {
 			continue
 		}
+		filesScanned.WithLabelValues(watch_dir).Inc()
+		filePath := filepath.Join(watch_dir, info.Name())
 
-		// Skip files smaller than the minimum size
-		if info.Size() < minFileSize {
-			if *debug {
-				log.Printf("[%s] Skipping file (too small): %s\n", currentTime(), info.Name())
-			}
+		if ok, reason := settings.Filter.Match(info.Name()); !ok {
+			slog.Debug("Skipping file", "file", info.Name(), "reason", reason)
+			countSkipped(filePath, "filtered", reason)
 			continue
 		}
 
-		// Apply includePrefix filtering if includePrefix is not empty
-		if len(includePrefix) > 0 && !hasPrefix(info.Name(), includePrefix) {
-			continue // Skip the file
+		// Skip files outside the size limits
+		if info.Size() < limits.MinFileSize {
+			slog.Debug("Skipping file", "file", info.Name(), "reason", "too small", "size", info.Size())
+			countSkipped(filePath, "too small", fmt.Sprintf("%d bytes", info.Size()))
+			continue
 		}
-
-		filePath := filepath.Join(watch_dir, info.Name())
-
-		if _, ok := processedFiles[filePath]; ok {
-			// File has already been processed
+		if limits.MaxFileSize > 0 && info.Size() > limits.MaxFileSize {
+			slog.Debug("Skipping file", "file", info.Name(), "reason", "too large", "size", info.Size())
+			countSkipped(filePath, "too large", fmt.Sprintf("%d bytes", info.Size()))
 			continue
 		}
 
-		full_destination_dir, shouldProcess := get_destination_dir(filePath, info)
-		if !shouldProcess {
-			log.Printf("[%s] Skipping file: %s (no valid date found)\n", currentTime(), filePath)
+		if skipProcessed && isProcessed(filePath) {
+			// File has already been processed
 			continue
 		}
 
-		full_destination := filepath.Join(full_destination_dir, info.Name())
+		candidates = append(candidates, &candidate{path: filePath, info: info})
+	}
+	return candidates, nil
+}
+
+func copy_files(ctx context.Context, settings watchSettings, extensions []string, limits mediaLimits, opts transferOptions, get_destination_dir func(filePath string, file os.FileInfo) route) error {
+	candidates, err := scanCandidates(settings, extensions, limits, true)
+	if err != nil {
+		return err
+	}
+
+	resolveDestinations(ctx, candidates, opts.Workers, settings.Action == "move", get_destination_dir)
+	claimed := claimDestinations(candidates)
+	defer releaseDestinations(claimed)
+
+	transferAll(ctx, claimed, opts, func(c *candidate) {
+		start := time.Now()
+		filePath, full_destination_dir, full_destination := c.path, c.route.dir, c.fullDestination
 		if _, err := os.Stat(full_destination_dir); os.IsNotExist(err) {
 			os.MkdirAll(full_destination_dir, os.ModePerm)
 		}
 		if _, err := os.Stat(full_destination); os.IsNotExist(err) {
-			err := copyAndVerify(filePath, full_destination)
+			checksum, err := copyAndVerify(filePath, full_destination, opts, c.route.dateTaken)
 			if err != nil {
-				log.Printf("[%s] Failed to copy file: %s\n", currentTime(), err)
+				slog.Error("Failed to copy file", "source", filePath, "destination", full_destination, "action", "copy", logging.Err(err))
+				countFailed(filePath, full_destination, "copy", false, err)
 			} else {
-				log.Printf("[%s] Copied file: %s to %s\n", currentTime(), filePath, full_destination)
+				tagFile(full_destination, c.route)
+				preview := writePreview(full_destination, c.route)
+				record := importRecord{Source: filePath, Destination: full_destination, Size: c.info.Size(), Algorithm: opts.Checksum, Checksum: checksum, Tags: c.route.tags, Rule: c.route.rule, DateSource: c.route.dateSource, TimeShift: c.route.timeShift, Preview: preview}
+				state.recordImport(record)
+				countImported(record, "copy", c.info.Size())
+				slog.Info("Copied file", "source", filePath, "destination", full_destination, "action", "copy", "hash", checksum, "duration", time.Since(start))
 				// Add to processed files and update the file immediately
-				processedFiles[filePath] = struct{}{}
-				appendToProcessedFiles(processedFilesPath, filePath)
+				markProcessed(filePath)
 			}
 		} else {
-			// Destination file already exists
-			processedFiles[filePath] = struct{}{}
-			// Ensure it's in the processed files list
-			appendToProcessedFiles(processedFilesPath, filePath)
+			// Destination file already exists, ensure it's in the processed files list
+			countCollision(filePath, "destination exists", full_destination)
+			markProcessed(filePath)
 		}
-	}
+	})
 	return nil
 }
 
-func move_photos(watch_dir string, destination_dir string, image_extensions []string) error {
-	return move_files(watch_dir, destination_dir, image_extensions, func(filePath string, file os.FileInfo) (string, bool) {
-		date_taken, err := getPhotoTimestamp(filePath)
-		if err != nil {
-			// Attempt to parse date from filename
-			date_taken, err = parseDateFromFilename(file.Name())
-			if err != nil {
-				log.Printf("[%s] Skipping photo %s: no valid date found\n", currentTime(), filePath)
-				return "", false
-			}
-		}
-		year_taken, month_taken, day_taken := date_taken.Date()
-		month_name := month_taken.String()
-		return filepath.Join(
-			destination_dir,
-			fmt.Sprintf("%d", year_taken),
-			fmt.Sprintf("%02d - %s", month_taken, month_name),
-			fmt.Sprintf("%04d-%02d-%02d", year_taken, int(month_taken), day_taken),
-		), true
+func move_photos(ctx context.Context, settings watchSettings, opts transferOptions) error {
+	return move_files(ctx, settings, settings.ImageExtensions, settings.Photos, opts, func(filePath string, file os.FileInfo) route {
+		return destinationDir(settings, settings.DateSources.Photos, settings.Photos, filePath, file)
 	})
 }
 
-func move_videos(watch_dir string, destination_dir string, video_extensions []string) error {
-	return move_files(watch_dir, destination_dir, video_extensions, func(filePath string, file os.FileInfo) (string, bool) {
-		date_taken, err := getVideoTimestamp(filePath)
-		if err != nil {
-			// Log a notification and skip the video
-			log.Printf("[%s] Skipping video %s: %v\n", currentTime(), filePath, err)
-			return "", false
-		}
-		year_taken, month_taken, day_taken := date_taken.Date()
-		month_name := month_taken.String()
-		return filepath.Join(
-			destination_dir,
-			fmt.Sprintf("%d", year_taken),
-			fmt.Sprintf("%02d - %s", month_taken, month_name),
-			fmt.Sprintf("%04d-%02d-%02d", year_taken, int(month_taken), day_taken),
-		), true
+func move_raws(ctx context.Context, settings watchSettings, opts transferOptions) error {
+	return move_files(ctx, settings, settings.RawExtensions, settings.Photos, opts, func(filePath string, file os.FileInfo) route {
+		return rawDestinationDir(settings, settings.Photos, filePath, file)
 	})
 }
 
-func copy_photos(watch_dir string, destination_dir string, image_extensions []string, includePrefix []string) error {
-	return copy_files(watch_dir, destination_dir, image_extensions, includePrefix, func(filePath string, file os.FileInfo) (string, bool) {
-		date_taken, err := getPhotoTimestamp(filePath)
-		if err != nil {
-			// Attempt to parse date from filename
-			date_taken, err = parseDateFromFilename(file.Name())
-			if err != nil {
-				log.Printf("[%s] Skipping photo %s: no valid date found\n", currentTime(), filePath)
-				return "", false
-			}
-		}
-		year_taken, month_taken, day_taken := date_taken.Date()
-		month_name := month_taken.String()
-		return filepath.Join(
-			destination_dir,
-			fmt.Sprintf("%d", year_taken),
-			fmt.Sprintf("%02d - %s", month_taken, month_name),
-			fmt.Sprintf("%04d-%02d-%02d", year_taken, int(month_taken), day_taken),
-		), true
+func move_videos(ctx context.Context, settings watchSettings, opts transferOptions) error {
+	return move_files(ctx, settings, settings.VideoExtensions, settings.Videos, opts, func(filePath string, file os.FileInfo) route {
+		return destinationDir(settings, settings.DateSources.Videos, settings.Videos, filePath, file)
 	})
 }
 
-func copy_videos(watch_dir string, destination_dir string, video_extensions []string, includePrefix []string) error {
-	return copy_files(watch_dir, destination_dir, video_extensions, includePrefix, func(filePath string, file os.FileInfo) (string, bool) {
-		date_taken, err := getVideoTimestamp(filePath)
-		if err != nil {
-			// Log a notification and skip the video
-			log.Printf("[%s] Skipping video %s: %v\n", currentTime(), filePath, err)
-			return "", false
-		}
-		year_taken, month_taken, day_taken := date_taken.Date()
-		month_name := month_taken.String()
-		return filepath.Join(
-			destination_dir,
-			fmt.Sprintf("%d", year_taken),
-			fmt.Sprintf("%02d - %s", month_taken, month_name),
-			fmt.Sprintf("%04d-%02d-%02d", year_taken, int(month_taken), day_taken),
-		), true
+func copy_photos(ctx context.Context, settings watchSettings, opts transferOptions) error {
+	return copy_files(ctx, settings, settings.ImageExtensions, settings.Photos, opts, func(filePath string, file os.FileInfo) route {
+		return destinationDir(settings, settings.DateSources.Photos, settings.Photos, filePath, file)
 	})
 }
 
-// getPhotoTimestamp extracts the DateTimeOriginal from the photo's EXIF data using ExifTool
-func getPhotoTimestamp(filePath string) (time.Time, error) {
-	et, err := exiftool.NewExiftool()
-	if err != nil {
-		return time.Time{}, fmt.Errorf("Error when creating Exiftool: %v", err)
-	}
-	defer et.Close()
+func copy_raws(ctx context.Context, settings watchSettings, opts transferOptions) error {
+	return copy_files(ctx, settings, settings.RawExtensions, settings.Photos, opts, func(filePath string, file os.FileInfo) route {
+		return rawDestinationDir(settings, settings.Photos, filePath, file)
+	})
+}
 
-	fileInfos := et.ExtractMetadata(filePath)
-	if len(fileInfos) == 0 {
-		return time.Time{}, fmt.Errorf("No metadata extracted for file: %s", filePath)
-	}
+func copy_videos(ctx context.Context, settings watchSettings, opts transferOptions) error {
+	return copy_files(ctx, settings, settings.VideoExtensions, settings.Videos, opts, func(filePath string, file os.FileInfo) route {
+		return destinationDir(settings, settings.DateSources.Videos, settings.Videos, filePath, file)
+	})
+}
 
-	fi := fileInfos[0]
-	if fi.Err != nil {
-		return time.Time{}, fi.Err
-	}
+// destinationDir works out where a photo or video goes from the given date
+// sources and the rules, falling back to the unknownDate policy
+func destinationDir(settings watchSettings, sources []string, limits mediaLimits, filePath string, file os.FileInfo) route {
+	meta, err := readMetadata(filePath)
+	switch {
+	case errors.Is(err, metadata.ErrCorrupt):
+		return route{err: err}
+	case err != nil:
+		// The file is still dated by its name, folder or mtime
+		slog.Debug("Failed to read metadata", "source", filePath, logging.Err(err))
+	}
+	if skip, why := limits.check(meta); skip != "" {
+		return route{skip: skip, why: why}
+	}
+	date_taken, dateSource, timeShift, err := dateFile(settings, sources, meta, filePath, file)
+	r := routeFile(settings, file, meta, date_taken, dateSource, err)
+	r.timeShift = timeShift
+	return r
+}
+
+// rawDestinationDir works out where a RAW file goes. They are dated like
+// photos but laid out by the RAW destination template.
+func rawDestinationDir(settings watchSettings, limits mediaLimits, filePath string, file os.FileInfo) route {
+	r := destinationDir(settings.raw(), settings.DateSources.Photos, limits, filePath, file)
+	r.preview = settings.RawPreviews
+	return r
+}
 
-	// Try to get DateTimeOriginal, CreateDate, ModifyDate, or DateTimeDigitized
-	var dateStr string
-	var ok bool
-	dateTags := []string{"DateTimeOriginal", "CreateDate", "ModifyDate", "DateTimeDigitized"}
+// datedDir returns the directory for date_taken under the destination of settings,
+// laid out by its destination template
+func datedDir(settings watchSettings, date_taken time.Time) string {
+	return filepath.Join(settings.DestinationDir, expandTemplate(settings.DestinationTemplate, date_taken))
+}
 
-	for _, tag := range dateTags {
-		dateStr, ok = fi.Fields[tag].(string)
-		if ok && dateStr != "" {
-			break
+// hasExtension checks if the filename has one of the specified extensions
+func hasExtension(filename string, extensions []string) bool {
+	fileExt := strings.ToLower(filepath.Ext(filename))
+	for _, ext := range extensions {
+		if fileExt == ext {
+			return true
 		}
 	}
+	return false
+}
+
+// copyAndVerify copies a file from src to dst and verifies the integrity.
+// The data is written to a hidden temporary file next to dst and only renamed
+// into place once it has been synced and verified, so an interrupted copy never
+// leaves a truncated file under the final name. Source attributes selected in
+// opts.Preserve are applied to the copy before the rename. It returns the
+// checksum of the source computed while copying.
+func copyAndVerify(src, dst string, opts transferOptions, captureTime time.Time) (string, error) {
+	start := time.Now()
+	defer func() { copyDuration.Observe(time.Since(start).Seconds()) }()
+	destinationDir := filepath.Dir(dst)
+
+	// Copy the file, hashing the source on the way through
+	tmp, srcChecksum, err := copyToTemp(src, destinationDir, opts.Checksum)
+	if err != nil {
+		return "", err
+	}
+	defer untrackTemp(tmp)
 
-	if !ok || dateStr == "" {
-		return time.Time{}, fmt.Errorf("No valid date tag found in EXIF data")
+	if err := verifyCopy(src, tmp, opts, srcChecksum); err != nil {
+		// Delete the temporary file if it doesn't match the source
+		os.Remove(tmp)
+		return "", err
 	}
 
-	dateFormats := []string{
-		"2006:01:02 15:04:05",
-		"2006:01:02 15:04:05-07:00",
-		"2006:01:02 15:04:05Z07:00",
+	// Failing to carry attributes over is not worth losing the import for
+	if err := preserveAttributes(src, tmp, opts.Preserve, captureTime); err != nil {
+		slog.Warn("Failed to preserve attributes", "source", src, logging.Err(err))
 	}
 
-	var parsedTime time.Time
-	var parseErr error
-	for _, format := range dateFormats {
-		parsedTime, parseErr = time.Parse(format, dateStr)
-		if parseErr == nil {
-			break
-		}
+	// Never clobber a file that appeared under the final name while we were copying
+	if _, err := os.Stat(dst); err == nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("destination file %s already exists", dst)
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("error renaming %s to %s: %v", tmp, dst, err)
 	}
 
-	if parseErr != nil {
-		return time.Time{}, fmt.Errorf("Error parsing date: %v", parseErr)
+	// Persist the rename itself
+	if err := syncDir(destinationDir); err != nil {
+		return "", fmt.Errorf("error syncing directory %s: %v", destinationDir, err)
 	}
 
-	return parsedTime, nil
+	return srcChecksum, nil
 }
 
-// getVideoTimestamp extracts the MediaCreateDate or CreateDate from the video's metadata using ExifTool
-func getVideoTimestamp(filePath string) (time.Time, error) {
-	et, err := exiftool.NewExiftool()
-	if err != nil {
-		return time.Time{}, fmt.Errorf("Error when creating Exiftool: %v", err)
+// verifyCopy checks the copy at dst against src according to opts.Verify:
+// "none" trusts the copy, "size" compares sizes and "hash" also reads dst back
+// and compares it with srcChecksum, computed while copying
+func verifyCopy(src, dst string, opts transferOptions, srcChecksum string) error {
+	if opts.Verify == "none" {
+		return nil
 	}
-	defer et.Close()
 
-	fileInfos := et.ExtractMetadata(filePath)
-	if len(fileInfos) == 0 {
-		return time.Time{}, fmt.Errorf("No metadata extracted for file: %s", filePath)
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("error stating source file: %v", err)
 	}
 
-	fi := fileInfos[0]
-	if fi.Err != nil {
-		return time.Time{}, fi.Err
+	// Check the file size of the copy
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return fmt.Errorf("error stating destination file: %v", err)
 	}
 
-	// Try to get MediaCreateDate, CreateDate, or ModifyDate
-	var dateStr string
-	var ok bool
-	dateTags := []string{"MediaCreateDate", "CreateDate", "ModifyDate"}
-
-	for _, tag := range dateTags {
-		dateStr, ok = fi.Fields[tag].(string)
-		if ok {
-			break
-		}
+	if dstInfo.Size() == 0 {
+		return fmt.Errorf("destination file %s has zero size after copy", dst)
 	}
 
-	if !ok {
-		return time.Time{}, fmt.Errorf("No valid date tag found in metadata")
+	if dstInfo.Size() != srcInfo.Size() {
+		return fmt.Errorf("size mismatch between source and destination files for %s", src)
 	}
 
-	// Remove timezone information in format "+00:00" if present
-	dateStr = strings.Replace(dateStr, "+00:00", "", 1)
-
-	dateFormats := []string{
-		"2006:01:02 15:04:05",
-		"2006:01:02 15:04:05-07:00",
-		"2006:01:02 15:04:05Z07:00",
+	if opts.Verify == "size" {
+		return nil
 	}
 
-	var parsedTime time.Time
-	var parseErr error
-	for _, format := range dateFormats {
-		parsedTime, parseErr = time.Parse(format, dateStr)
-		if parseErr == nil {
-			break
-		}
+	destChecksum, err := computeFileChecksum(dst, opts.Checksum)
+	if err != nil {
+		return fmt.Errorf("error computing checksum of destination file: %v", err)
 	}
 
-	if parseErr != nil {
-		return time.Time{}, fmt.Errorf("Error parsing date: %v", parseErr)
+	if srcChecksum != destChecksum {
+		return fmt.Errorf("checksum mismatch between source and destination files for %s", src)
 	}
 
-	return parsedTime, nil
+	return nil
 }
 
-// hasExtension checks if the filename has one of the specified extensions
-func hasExtension(filename string, extensions []string) bool {
-	fileExt := strings.ToLower(filepath.Ext(filename))
-	for _, ext := range extensions {
-		if fileExt == ext {
-			return true
-		}
+// renameNoClobber moves src to dst on the same filesystem without overwriting an
+// existing file, then syncs both directories so the move survives a crash
+func renameNoClobber(src, dst string, opts transferOptions, captureTime time.Time) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("destination file %s already exists", dst)
 	}
-	return false
-}
 
-// hasPrefix checks if the filename starts with any of the specified prefixes
-func hasPrefix(filename string, prefixes []string) bool {
-	for _, prefix := range prefixes {
-		if strings.HasPrefix(filename, prefix) {
-			return true
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %v", src, dst, err)
+	}
+
+	// A rename keeps every attribute, only the capture time override needs applying
+	if opts.Preserve.MtimeFromCaptureTime && !captureTime.IsZero() {
+		if info, err := os.Stat(dst); err == nil {
+			os.Chtimes(dst, fileAtime(info), captureTime)
 		}
 	}
-	return false
-}
 
-// currentTime returns the current time as a formatted string with timezone.
-func currentTime() string {
-	return time.Now().Format("2006-01-02 15:04:05 MST")
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return fmt.Errorf("error syncing directory %s: %v", filepath.Dir(dst), err)
+	}
+	if err := syncDir(filepath.Dir(src)); err != nil {
+		return fmt.Errorf("error syncing directory %s: %v", filepath.Dir(src), err)
+	}
+	return nil
 }
 
-// copyAndVerify copies a file from src to dst and verifies the integrity
-func copyAndVerify(src, dst string) error {
-	// Copy the file
-	err := copyFile(src, dst)
+// tempFileSuffix marks in-progress copies in the destination directories
+const tempFileSuffix = ".movephoto-tmp"
+
+// copyToTemp copies src into a hidden temporary file inside dir, fsyncs it and
+// returns its path along with the checksum of the data read from src
+func copyToTemp(src, dir string, algorithm string) (string, string, error) {
+	sourceFileStat, err := os.Stat(src)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	// Check the file size of the destination
-	destInfo, err := os.Stat(dst)
-	if err != nil {
-		// Delete the incomplete destination file
-		os.Remove(dst)
-		return fmt.Errorf("error stating destination file: %v", err)
+	if !sourceFileStat.Mode().IsRegular() {
+		return "", "", fmt.Errorf("%s is not a regular file", src)
 	}
 
-	if destInfo.Size() == 0 {
-		// Delete the empty destination file
-		os.Remove(dst)
-		return fmt.Errorf("destination file %s has zero size after copy", dst)
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", "", err
 	}
 
-	// Compute checksums of source and destination
-	srcChecksum, err := computeFileChecksum(src)
+	source, err := os.Open(src)
 	if err != nil {
-		// Delete the destination file if checksum fails
-		os.Remove(dst)
-		return fmt.Errorf("error computing checksum of source file: %v", err)
+		return "", "", err
 	}
+	defer source.Close()
 
-	destChecksum, err := computeFileChecksum(dst)
+	noteTempDir(dir)
+	destination, err := os.CreateTemp(dir, "."+filepath.Base(src)+".*"+tempFileSuffix)
 	if err != nil {
-		// Delete the destination file if checksum fails
-		os.Remove(dst)
-		return fmt.Errorf("error computing checksum of destination file: %v", err)
+		return "", "", err
 	}
+	tmp := destination.Name()
+	trackTemp(tmp)
 
-	if srcChecksum != destChecksum {
-		// Delete the destination file if checksums don't match
-		os.Remove(dst)
-		return fmt.Errorf("checksum mismatch between source and destination files for %s", src)
+	// Delete the incomplete temporary file on any failure
+	fail := func(err error) (string, string, error) {
+		destination.Close()
+		os.Remove(tmp)
+		untrackTemp(tmp)
+		return "", "", err
 	}
 
-	return nil
-}
+	// CreateTemp always uses 0600, match the source instead
+	if err := destination.Chmod(sourceFileStat.Mode().Perm()); err != nil {
+		return fail(err)
+	}
 
-// Function to parse date from filename
-func parseDateFromFilename(filename string) (time.Time, error) {
-	// Define regex patterns for iPhone and Pixel filenames
-	iphonePattern := regexp.MustCompile(`(\d{8})_\d{9}_iOS`)
-	pixelPattern := regexp.MustCompile(`PXL_(\d{8})_\d{9}`)
+	nBytes, err := io.Copy(destination, io.TeeReader(source, h))
+	if err != nil {
+		return fail(err)
+	}
+
+	if nBytes == 0 {
+		// Delete the empty temporary file
+		return fail(fmt.Errorf("copied zero bytes from %s to %s", src, tmp))
+	}
 
-	// Check for iPhone pattern
-	if matches := iphonePattern.FindStringSubmatch(filename); matches != nil {
-		return time.Parse("20060102", matches[1])
+	// Make sure the data is on disk before it can be renamed into place
+	if err := destination.Sync(); err != nil {
+		return fail(err)
 	}
 
-	// Check for Pixel pattern
-	if matches := pixelPattern.FindStringSubmatch(filename); matches != nil {
-		return time.Parse("20060102", matches[1])
+	if err := destination.Close(); err != nil {
+		os.Remove(tmp)
+		untrackTemp(tmp)
+		return "", "", err
 	}
 
-	return time.Time{}, fmt.Errorf("no date found in filename")
+	return tmp, hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// copyFile copies a file from src to dst
-func copyFile(src, dst string) error {
-	sourceFileStat, err := os.Stat(src)
+// syncDir fsyncs a directory so that renames inside it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
+	defer d.Close()
 
-	if !sourceFileStat.Mode().IsRegular() {
-		return fmt.Errorf("%s is not a regular file", src)
+	// Some filesystems (e.g. drvfs and SMB mounts) don't support syncing directories
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		return err
 	}
+	return nil
+}
 
-	// Check if destination file exists
-	if _, err := os.Stat(dst); err == nil {
-		return fmt.Errorf("destination file %s already exists", dst)
+// inFlightTemps holds the temporary files currently being written, so they
+// can be rolled back if the process has to stop before they are finished
+var inFlightTemps = struct {
+	sync.Mutex
+	paths map[string]struct{}
+}{paths: make(map[string]struct{})}
+
+// trackTemp registers a temporary file that is being written
+func trackTemp(path string) {
+	inFlightTemps.Lock()
+	defer inFlightTemps.Unlock()
+	inFlightTemps.paths[path] = struct{}{}
+}
+
+// untrackTemp forgets a temporary file that was renamed into place or removed
+func untrackTemp(path string) {
+	inFlightTemps.Lock()
+	defer inFlightTemps.Unlock()
+	delete(inFlightTemps.paths, path)
+}
+
+// removeInFlightTemps deletes every temporary file that is still being written
+func removeInFlightTemps() {
+	inFlightTemps.Lock()
+	defer inFlightTemps.Unlock()
+	for path := range inFlightTemps.paths {
+		if err := os.Remove(path); err == nil {
+			slog.Info("Rolled back unfinished copy", "path", path)
+		}
+		delete(inFlightTemps.paths, path)
 	}
+}
 
-	source, err := os.Open(src)
+// isTempFile reports whether name looks like a temporary file left behind by copyToTemp
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// tempDirsName is the journal of the directories temporary files were created
+// in, kept next to the state database. After a crash only those directories
+// are searched for leftovers instead of the whole library.
+const tempDirsName = "movephoto_temp_dirs.txt"
+
+// tempDirs is the open journal of directories with temporary files
+var tempDirs = struct {
+	sync.Mutex
+	path  string          // Empty until openTempDirs
+	known map[string]bool // Directories already in the journal
+}{known: make(map[string]bool)}
+
+// noteTempDir records dir in the journal before a temporary file is created
+// in it, syncing the journal so that it survives a power loss
+func noteTempDir(dir string) {
+	tempDirs.Lock()
+	defer tempDirs.Unlock()
+	if tempDirs.path == "" || tempDirs.known[dir] {
+		return
+	}
+	file, err := os.OpenFile(tempDirs.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = fmt.Fprintln(file, dir)
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
 	if err != nil {
-		return err
+		slog.Warn("Failed to record directory of temporary file", "dir", dir, "journal", tempDirs.path, logging.Err(err))
+		return
 	}
-	defer source.Close()
+	tempDirs.known[dir] = true
+}
 
-	destination, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, sourceFileStat.Mode())
-	if err != nil {
-		return err
+// openTempDirs removes the temporary files left in the directories of the
+// journal in destinationDir and starts it over. Without a journal, the first
+// start of a version that keeps one, dirs are searched in full once.
+func openTempDirs(destinationDir string, dirs []string) {
+	tempDirs.Lock()
+	defer tempDirs.Unlock()
+	path := filepath.Join(destinationDir, tempDirsName)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		seen := make(map[string]bool)
+		for _, dir := range strings.Split(string(data), "\n") {
+			if dir != "" && !seen[dir] {
+				seen[dir] = true
+				cleanupTempDir(dir)
+			}
+		}
+	case os.IsNotExist(err):
+		for _, dir := range dirs {
+			if err := cleanupTempFiles(dir); err != nil {
+				slog.Error("Failed to clean up temporary files", "dir", dir, logging.Err(err))
+			}
+		}
+	default:
+		slog.Error("Failed to read journal of temporary files", "path", path, logging.Err(err))
+	}
+
+	// A destination that doesn't exist yet gets its journal with its first copy
+	if err := os.WriteFile(path, nil, 0644); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to reset journal of temporary files", "path", path, logging.Err(err))
 	}
-	defer destination.Close()
+	tempDirs.path, tempDirs.known = path, make(map[string]bool)
+}
 
-	nBytes, err := io.Copy(destination, source)
+// cleanupTempDir removes temporary files left behind by interrupted copies in dir
+func cleanupTempDir(dir string) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		// Delete the incomplete destination file
-		os.Remove(dst)
-		return err
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to clean up temporary files", "dir", dir, logging.Err(err))
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isTempFile(entry.Name()) {
+			removeTempFile(filepath.Join(dir, entry.Name()))
+		}
 	}
+}
 
-	if nBytes == 0 {
-		// Delete the empty destination file
-		os.Remove(dst)
-		return fmt.Errorf("copied zero bytes from %s to %s", src, dst)
+// cleanupTempFiles removes temporary files left behind by interrupted copies under root
+func cleanupTempFiles(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() && isTempFile(d.Name()) {
+			removeTempFile(path)
+		}
+		return nil
+	})
+}
+
+// removeTempFile removes a leftover temporary file
+func removeTempFile(path string) {
+	if err := os.Remove(path); err != nil {
+		slog.Error("Failed to remove leftover temporary file", "path", path, logging.Err(err))
+	} else {
+		slog.Info("Removed leftover temporary file", "path", path)
 	}
+}
 
-	return nil
+// newHash returns a hash for one of the supported checksum algorithms
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "blake3":
+		return blake3.New(32, nil), nil
+	case "xxhash":
+		return xxhash.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
 }
 
-// computeFileChecksum computes the MD5 checksum of a file
-func computeFileChecksum(filePath string) (string, error) {
+// computeFileChecksum computes the checksum of a file with the given algorithm
+func computeFileChecksum(filePath string, algorithm string) (string, error) {
+	hash, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	hash := md5.New()
 	if _, err := io.Copy(hash, file); err != nil {
 		return "", err
 	}
@@ -623,7 +944,7 @@ func loadProcessedFiles(filePath string) map[string]struct{} {
 		if os.IsNotExist(err) {
 			return processedFiles
 		}
-		log.Fatalf("Error opening processed files list: %v", err)
+		logging.Fatal("Error opening processed files list", "path", filePath, logging.Err(err))
 	}
 	defer file.Close()
 
@@ -633,11 +954,30 @@ func loadProcessedFiles(filePath string) map[string]struct{} {
 		processedFiles[line] = struct{}{}
 	}
 	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading processed files list: %v", err)
+		logging.Fatal("Error reading processed files list", "path", filePath, logging.Err(err))
 	}
 	return processedFiles
 }
 
+// isProcessed reports whether filePath has already been copied
+func isProcessed(filePath string) bool {
+	processedFilesMu.Lock()
+	defer processedFilesMu.Unlock()
+	_, ok := processedFiles[filePath]
+	return ok
+}
+
+// markProcessed adds filePath to the processed files and the list on disk
+func markProcessed(filePath string) {
+	processedFilesMu.Lock()
+	defer processedFilesMu.Unlock()
+	if _, ok := processedFiles[filePath]; ok {
+		return
+	}
+	processedFiles[filePath] = struct{}{}
+	appendToProcessedFiles(processedFilesPath, filePath)
+}
+
 // appendToProcessedFiles appends a file path to the processed files list
 func appendToProcessedFiles(filePath, processedFile string) {
 	// Ensure the directory exists
@@ -648,11 +988,11 @@ func appendToProcessedFiles(filePath, processedFile string) {
 
 	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatalf("Error opening processed files list for appending: %v", err)
+		logging.Fatal("Error opening processed files list for appending", "path", filePath, logging.Err(err))
 	}
 	defer file.Close()
 
 	if _, err := file.WriteString(processedFile + "\n"); err != nil {
-		log.Fatalf("Error writing to processed files list: %v", err)
+		logging.Fatal("Error writing to processed files list", "path", filePath, logging.Err(err))
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenTempDirs(t *testing.T) {
+	destination := t.TempDir()
+	written, untouched := filepath.Join(destination, "2024", "01"), filepath.Join(destination, "2023", "12")
+	var leftovers []string
+	for _, dir := range []string{written, untouched} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, ".a.jpg.123"+tempFileSuffix)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		leftovers = append(leftovers, path)
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	defer func() { tempDirs.path = "" }()
+
+	// Only the directories in the journal are searched
+	journal := filepath.Join(destination, tempDirsName)
+	if err := os.WriteFile(journal, []byte(written+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	openTempDirs(destination, []string{destination})
+	if exists(leftovers[0]) || !exists(leftovers[1]) {
+		t.Errorf("leftovers after the journal: %v and %v, want only the second", exists(leftovers[0]), exists(leftovers[1]))
+	}
+	if data, _ := os.ReadFile(journal); len(data) != 0 {
+		t.Errorf("journal after opening it = %q, want it empty", data)
+	}
+	noteTempDir(written)
+	noteTempDir(written)
+	if data, _ := os.ReadFile(journal); strings.Count(string(data), written) != 1 {
+		t.Errorf("journal = %q, want %s once", data, written)
+	}
+
+	// Without a journal the destination is searched in full
+	os.Remove(journal)
+	openTempDirs(destination, []string{destination})
+	if exists(leftovers[1]) {
+		t.Error("the first start without a journal left a temporary file behind")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"movephoto/logging"
+)
+
+// candidate is a file in a watch directory that passed the cheap filters and
+// is waiting to be imported
+type candidate struct {
+	path            string
+	info            os.FileInfo
+	route           route
+	fullDestination string // Set once the destination name has been claimed
+}
+
+// claimedDestinations holds the destination paths that an import is currently
+// writing to, so that no two files are ever given the same name
+var claimedDestinations = struct {
+	sync.Mutex
+	paths map[string]string // Destination path to source path
+}{paths: make(map[string]string)}
+
+// deviceSlots limits the number of concurrent transfers per destination device
+var deviceSlots = struct {
+	sync.Mutex
+	slots map[string]chan struct{}
+}{slots: make(map[string]chan struct{})}
+
+// forEach runs fn for every index in [0, n) on at most workers goroutines
+func forEach(n int, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// resolveDestinations extracts the metadata of every candidate in parallel and
+// works out its destination directory. Files that failed before are left out
+// until their next attempt is due; moveMode tells where files that can't be
+// dated end up after the last attempt.
+func resolveDestinations(ctx context.Context, candidates []*candidate, workers int, moveMode bool, get_destination_dir func(filePath string, file os.FileInfo) route) {
+	forEach(len(candidates), workers, func(i int) {
+		c := candidates[i]
+		if ctx.Err() != nil {
+			return // Shutting down, leave the file for the next run
+		}
+		if reason, why := failures.check(c); reason != "" {
+			c.route = route{skip: reason, why: why}
+			countSkipped(c.path, reason, why)
+			slog.Debug("Skipping file", "source", c.path, "reason", reason, "details", why)
+			return
+		}
+		c.route = get_destination_dir(c.path, c.info)
+		if c.route.err != nil {
+			slog.Error("Failed to read file", "source", c.path, logging.Err(c.route.err))
+			countFailed(c.path, "", "read", moveMode, c.route.err)
+		} else if c.route.skip != "" {
+			countSkipped(c.path, c.route.skip, c.route.why)
+			args := []any{"source", c.path, "reason", c.route.skip}
+			if c.route.why != "" {
+				args = append(args, "details", c.route.why)
+			}
+			slog.Info("Skipping file", args...)
+			if c.route.skip == skipNoDate {
+				trackFailure(c.path, skipNoDate, c.route.why, moveMode)
+			}
+		} else if c.route.rule != "" {
+			slog.Debug("Routing file", "source", c.path, "destination", c.route.dir, "rule", c.route.rule)
+		}
+	})
+}
+
+// claimDestinations assigns destination names in candidate order, which is the
+// sorted directory listing, so the same file always wins a collision. Candidates
+// whose name is already claimed by an earlier file or a concurrent import are
+// left out. The returned candidates must be released with releaseDestinations.
+func claimDestinations(candidates []*candidate) []*candidate {
+	claimedDestinations.Lock()
+	defer claimedDestinations.Unlock()
+
+	var claimed []*candidate
+	for _, c := range candidates {
+		if c.route.skip != "" || c.route.err != nil {
+			continue
+		}
+		full_destination := filepath.Join(c.route.dir, c.info.Name())
+		if owner, ok := claimedDestinations.paths[full_destination]; ok {
+			slog.Info("Skipping file", "source", c.path, "reason", "destination in use", "destination", full_destination, "writer", owner)
+			countCollision(c.path, "destination in use", full_destination)
+			continue
+		}
+		claimedDestinations.paths[full_destination] = c.path
+		c.fullDestination = full_destination
+		claimed = append(claimed, c)
+	}
+	return claimed
+}
+
+// releaseDestinations gives up the destination names claimed for candidates
+func releaseDestinations(candidates []*candidate) {
+	claimedDestinations.Lock()
+	defer claimedDestinations.Unlock()
+
+	for _, c := range candidates {
+		delete(claimedDestinations.paths, c.fullDestination)
+	}
+}
+
+// acquireDeviceSlot blocks until a transfer to the device holding dir may start
+// and returns the function that gives the slot back
+func acquireDeviceSlot(dir string, limit int) func() {
+	if limit < 1 {
+		return func() {}
+	}
+
+	key := deviceKey(dir)
+	deviceSlots.Lock()
+	slot, ok := deviceSlots.slots[key]
+	if !ok {
+		slot = make(chan struct{}, limit)
+		deviceSlots.slots[key] = slot
+	}
+	deviceSlots.Unlock()
+
+	slot <- struct{}{}
+	return func() { <-slot }
+}
+
+// transferAll runs transfer for every claimed candidate on the worker pool,
+// respecting the per-device limit on the destination. Candidates that haven't
+// started when ctx is cancelled, or that a preImport hook rejects, are skipped.
+// The hooks run before the device slot is taken, so they don't hold it up.
+func transferAll(ctx context.Context, candidates []*candidate, opts transferOptions, transfer func(c *candidate)) {
+	queueDepth.Add(float64(len(candidates)))
+	for _, c := range candidates {
+		status.queue(c)
+	}
+	forEach(len(candidates), opts.Workers, func(i int) {
+		c := candidates[i]
+		defer status.dequeue(c)
+		defer queueDepth.Dec()
+		if ctx.Err() != nil {
+			return
+		}
+		if err := hooks.preImport(c); err != nil {
+			slog.Info("Skipping file", "source", c.path, "reason", "rejected by hook", logging.Err(err))
+			countSkipped(c.path, "rejected by hook", err.Error())
+			return
+		}
+		release := acquireDeviceSlot(destinationDeviceDir(c.route.dir), opts.DeviceWorkers)
+		defer release()
+		if ctx.Err() != nil {
+			return
+		}
+		status.startTransfer(c)
+		transfer(c)
+	})
+}
+
+// destinationDeviceDir returns the closest existing ancestor of dir, which is
+// on the same device dir will be created on
+func destinationDeviceDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// preserveAttributes carries the attributes selected in preserve over from src to dst.
+// Timestamps are applied last because changing ownership or xattrs can touch them.
+func preserveAttributes(src, dst string, preserve Preserve, captureTime time.Time) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+
+	// Only root can hand files to another user
+	if preserve.Ownership && os.Geteuid() == 0 {
+		if err := copyOwnership(srcInfo, dst); err != nil {
+			problems = append(problems, fmt.Sprintf("ownership: %v", err))
+		}
+	}
+
+	if preserve.Xattrs {
+		if err := copyXattrs(src, dst); err != nil {
+			problems = append(problems, fmt.Sprintf("xattrs: %v", err))
+		}
+	}
+
+	if preserve.Mtime || preserve.Atime || preserve.MtimeFromCaptureTime {
+		dstInfo, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		atime, mtime := fileAtime(dstInfo), dstInfo.ModTime()
+		if preserve.Atime {
+			atime = fileAtime(srcInfo)
+		}
+		if preserve.Mtime {
+			mtime = srcInfo.ModTime()
+		}
+		if preserve.MtimeFromCaptureTime && !captureTime.IsZero() {
+			mtime = captureTime
+		}
+		if err := os.Chtimes(dst, atime, mtime); err != nil {
+			problems = append(problems, fmt.Sprintf("timestamps: %v", err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkPlatformSupport warns about the preserve options and rule tags of
+// config that this platform can't write and ignores
+func checkPlatformSupport(config Config, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	options := map[string]bool{"atime": config.Preserve.Atime, "ownership": config.Preserve.Ownership, "xattrs": config.Preserve.Xattrs}
+	for _, name := range unsupportedAttributes {
+		if options[name] {
+			problems = append(problems, configProblem{Line: lineOf(root, "preserve", name), Message: fmt.Sprintf("preserve.%s is not supported on %s and is ignored", name, runtime.GOOS), Warning: true})
+		}
+		if name != "tags" {
+			continue
+		}
+		for i, rule := range config.Rules {
+			if len(rule.Action.Tags) > 0 {
+				problems = append(problems, configProblem{Line: lineOf(root, "rules", i, "action", "tags"), Message: fmt.Sprintf("tags of %s are only recorded in the state database on %s", ruleName(rule, i), runtime.GOOS), Warning: true})
+			}
+		}
+	}
+	return problems
+}
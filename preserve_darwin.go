@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/sys/unix"
+)
+
+// finderTagsAttr is the extended attribute Finder keeps the tags of a file in
+const finderTagsAttr = "com.apple.metadata:_kMDItemUserTags"
+
+// fileAtime returns the last access time recorded in info
+func fileAtime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(stat.Atimespec.Sec, stat.Atimespec.Nsec)
+}
+
+// writeTags stores tags as the Finder tags of path
+func writeTags(path string, tags []string) error {
+	return unix.Setxattr(path, finderTagsAttr, tagsPlist(tags), 0)
+}
+
+// tagsPlist encodes tags as the binary property list Finder expects: an array
+// of strings, followed by the table of object offsets and the trailer
+func tagsPlist(tags []string) []byte {
+	refSize := 1
+	if len(tags) >= 255 {
+		refSize = 2
+	}
+	data := []byte("bplist00")
+	offsets := []int{len(data)}
+	data = plistMarker(data, 0xa, len(tags))
+	for i := range tags {
+		data = plistUint(data, uint64(i+1), refSize)
+	}
+	for _, tag := range tags {
+		offsets = append(offsets, len(data))
+		if ascii(tag) {
+			data = append(plistMarker(data, 0x5, len(tag)), tag...)
+			continue
+		}
+		units := utf16.Encode([]rune(tag))
+		data = plistMarker(data, 0x6, len(units))
+		for _, unit := range units {
+			data = binary.BigEndian.AppendUint16(data, unit)
+		}
+	}
+
+	tableOffset := len(data)
+	offsetSize := 1
+	for tableOffset >= 1<<(8*offsetSize) {
+		offsetSize *= 2
+	}
+	for _, offset := range offsets {
+		data = plistUint(data, uint64(offset), offsetSize)
+	}
+	data = append(data, 0, 0, 0, 0, 0, 0, byte(offsetSize), byte(refSize))
+	data = binary.BigEndian.AppendUint64(data, uint64(len(offsets)))
+	data = binary.BigEndian.AppendUint64(data, 0) // The array is the top object
+	return binary.BigEndian.AppendUint64(data, uint64(tableOffset))
+}
+
+// plistMarker appends the marker of an object of type typ with n elements,
+// which counts of 15 and more follow as an integer object
+func plistMarker(data []byte, typ byte, n int) []byte {
+	if n < 15 {
+		return append(data, typ<<4|byte(n))
+	}
+	data = append(data, typ<<4|0xf)
+	switch {
+	case n < 1<<8:
+		return plistUint(append(data, 0x10), uint64(n), 1)
+	case n < 1<<16:
+		return plistUint(append(data, 0x11), uint64(n), 2)
+	}
+	return plistUint(append(data, 0x12), uint64(n), 4)
+}
+
+// plistUint appends v as a big endian integer of size bytes
+func plistUint(data []byte, v uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		data = append(data, byte(v>>(8*i)))
+	}
+	return data
+}
+
+// ascii reports whether s holds only ASCII characters
+func ascii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
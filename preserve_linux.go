@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileAtime returns the last access time recorded in info
+func fileAtime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+}
+
+// writeTags stores tags in the user.xdg.tags attribute understood by file managers
+func writeTags(path string, tags []string) error {
+	return unix.Setxattr(path, "user.xdg.tags", []byte(strings.Join(tags, ",")), 0)
+}
@@ -0,0 +1,33 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// unsupportedAttributes lists the preserve options and rule tags this
+// platform can't write, which checkConfig warns about
+var unsupportedAttributes = []string{"atime", "ownership", "xattrs", "tags"}
+
+// fileAtime falls back to the modification time where the access time isn't available
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// copyOwnership is not supported on this platform
+func copyOwnership(srcInfo os.FileInfo, dst string) error {
+	return nil
+}
+
+// copyXattrs is not supported on this platform
+func copyXattrs(src, dst string) error {
+	return nil
+}
+
+// writeTags is not supported on this platform
+func writeTags(path string, tags []string) error {
+	return nil
+}
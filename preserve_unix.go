@@ -0,0 +1,84 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// unsupportedAttributes lists the preserve options and rule tags this
+// platform can't write, none on Linux and macOS
+var unsupportedAttributes []string
+
+// copyOwnership gives dst the owner and group recorded in srcInfo
+func copyOwnership(srcInfo os.FileInfo, dst string) error {
+	stat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+}
+
+// copyXattrs copies every extended attribute of src to dst, which on macOS
+// includes Finder tags and comments. Filesystems without xattr support are
+// not treated as an error.
+func copyXattrs(src, dst string) error {
+	size, err := unix.Listxattr(src, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(src, buf)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err == nil {
+			err = unix.Setxattr(dst, name, value, 0)
+		}
+		if err != nil {
+			if errors.Is(err, unix.ENOTSUP) {
+				return nil
+			}
+			failed = append(failed, name+": "+err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// getXattr reads a single extended attribute of path
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Getxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"movephoto/logging"
+	"movephoto/metadata"
+)
+
+// previewSuffix replaces the extension of a RAW file in the name of its preview
+const previewSuffix = "-preview.jpg"
+
+// previewPath returns where the preview of the RAW file at path goes. The
+// suffix keeps it apart from the JPEG of cameras shooting RAW+JPEG.
+func previewPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + previewSuffix
+}
+
+// writePreview writes the JPEG preview of the imported RAW file at path next
+// to it if r asks for one, returning the path of the preview. The RAW file is
+// imported either way, so failures are only logged.
+func writePreview(path string, r route) string {
+	if !r.preview {
+		return ""
+	}
+	preview := previewPath(path)
+	if err := extractPreview(path, preview); err != nil {
+		slog.Warn("Failed to write preview", "source", path, "destination", preview, logging.Err(err))
+		return ""
+	}
+	slog.Debug("Wrote preview", "source", path, "destination", preview)
+	return preview
+}
+
+// extractPreview writes the preview of the RAW file at path to destination
+// through a temporary file, without overwriting an existing file
+func extractPreview(path, destination string) error {
+	data, err := metadata.Preview(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(destination); err == nil {
+		return fmt.Errorf("destination file %s already exists", destination)
+	}
+
+	dir := filepath.Dir(destination)
+	noteTempDir(dir)
+	file, err := os.CreateTemp(dir, "."+filepath.Base(destination)+".*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	trackTemp(tmp)
+	defer untrackTemp(tmp)
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, destination)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
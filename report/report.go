@@ -0,0 +1,263 @@
+// Package report collects what one run of the importer or the dedupe tool did
+// and writes it out as a JSON file and, optionally, an HTML page.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failure is a file the run failed to handle
+type Failure struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination,omitempty"`
+	Action      string    `json:"action"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+}
+
+// Report counts the outcomes of one run. It is safe for concurrent use.
+type Report struct {
+	mu       sync.Mutex
+	order    []string       // Outcomes always listed, in this order
+	Tool     string         `json:"tool"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Duration float64        `json:"durationSeconds"`
+	Outcomes map[string]int `json:"outcomes"` // Files by outcome, e.g. imported or failed
+	Skipped  map[string]int `json:"skipped"`  // Files left alone, by reason
+	Bytes    int64          `json:"bytes"`    // Bytes copied, or freed by the dedupe tool
+	Failures []Failure      `json:"failures"`
+}
+
+// New starts a report for tool. The given outcomes are listed even when no
+// file had them.
+func New(tool string, outcomes ...string) *Report {
+	r := &Report{Tool: tool, order: outcomes}
+	r.Reset()
+	return r
+}
+
+// Reset starts counting a new run
+func (r *Report) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Started = time.Now()
+	r.Finished = time.Time{}
+	r.Duration = 0
+	r.Outcomes = make(map[string]int)
+	for _, outcome := range r.order {
+		r.Outcomes[outcome] = 0
+	}
+	r.Skipped = make(map[string]int)
+	r.Bytes = 0
+	r.Failures = []Failure{}
+}
+
+// Add counts a file with outcome and bytes copied or freed
+func (r *Report) Add(outcome string, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Outcomes[outcome]++
+	r.Bytes += bytes
+}
+
+// Skip counts a file that was left alone for reason
+func (r *Report) Skip(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped[reason]++
+}
+
+// Fail counts a failed file under the "failed" outcome and lists it
+func (r *Report) Fail(f Failure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f.Time.IsZero() {
+		f.Time = time.Now()
+	}
+	r.Outcomes["failed"]++
+	r.Failures = append(r.Failures, f)
+}
+
+// Count returns the number of files with outcome so far
+func (r *Report) Count(outcome string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Outcomes[outcome]
+}
+
+// TotalBytes returns the bytes copied or freed so far
+func (r *Report) TotalBytes() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Bytes
+}
+
+// Elapsed returns the duration of the run, up to now if it hasn't finished
+func (r *Report) Elapsed() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Finished.IsZero() {
+		return time.Since(r.Started)
+	}
+	return r.Finished.Sub(r.Started)
+}
+
+// Finish records the end of the run
+func (r *Report) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started).Seconds()
+}
+
+// FailureList returns a copy of the failures so far
+func (r *Report) FailureList() []Failure {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Failure(nil), r.Failures...)
+}
+
+// String formats the counts, e.g. "3 imported, 0 failed, 2 skipped (1 filtered, 1 too small)"
+func (r *Report) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	parts := make([]string, 0, len(r.Outcomes)+1)
+	for _, outcome := range r.outcomes() {
+		parts = append(parts, fmt.Sprintf("%d %s", r.Outcomes[outcome], outcome))
+	}
+
+	total := 0
+	reasons := sortedKeys(r.Skipped)
+	for _, reason := range reasons {
+		total += r.Skipped[reason]
+	}
+	skipped := fmt.Sprintf("%d skipped", total)
+	if total > 0 {
+		counts := make([]string, len(reasons))
+		for i, reason := range reasons {
+			counts[i] = fmt.Sprintf("%d %s", r.Skipped[reason], reason)
+		}
+		skipped += " (" + strings.Join(counts, ", ") + ")"
+	}
+	return strings.Join(append(parts, skipped), ", ")
+}
+
+// outcomes returns the fixed outcomes followed by any others in sorted order
+func (r *Report) outcomes() []string {
+	outcomes := append([]string(nil), r.order...)
+	known := make(map[string]bool)
+	for _, outcome := range r.order {
+		known[outcome] = true
+	}
+	for _, outcome := range sortedKeys(r.Outcomes) {
+		if !known[outcome] {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+	return outcomes
+}
+
+// Write saves the report as <tool>-<start time>.json in dir, and as .html next
+// to it with withHTML. It returns the path of the JSON file.
+func (r *Report) Write(dir string, withHTML bool) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	base := filepath.Join(dir, fmt.Sprintf("%s-%s", r.Tool, r.Started.Format("2006-01-02T15-04-05.000")))
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(base+".json", append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+
+	if withHTML {
+		file, err := os.Create(base + ".html")
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		if err := htmlTemplate.Execute(file, htmlData{Report: r, Order: r.outcomes(), Reasons: sortedKeys(r.Skipped)}); err != nil {
+			return "", err
+		}
+		if err := file.Close(); err != nil {
+			return "", err
+		}
+	}
+	return base + ".json", nil
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// htmlData is what the HTML template renders
+type htmlData struct {
+	*Report
+	Order   []string
+	Reasons []string
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Tool}} run {{time .Started}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>{{.Tool}} run {{time .Started}}</h1>
+<p>Finished {{time .Finished}} after {{printf "%.1f" .Duration}} seconds, {{.Bytes}} bytes.</p>
+<table>
+<tr><th>Outcome</th><th>Files</th></tr>
+{{- range .Order}}
+<tr><td>{{.}}</td><td>{{index $.Outcomes .}}</td></tr>
+{{- end}}
+</table>
+{{- if .Reasons}}
+<table>
+<tr><th>Skipped because</th><th>Files</th></tr>
+{{- range .Reasons}}
+<tr><td>{{.}}</td><td>{{index $.Skipped .}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Failures}}
+<table>
+<tr><th>Failed file</th><th>Destination</th><th>Action</th><th>Error</th><th>Time</th></tr>
+{{- range .Failures}}
+<tr><td>{{.Source}}</td><td>{{.Destination}}</td><td>{{.Action}}</td><td>{{.Error}}</td><td>{{time .Time}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"movephoto/logging"
+)
+
+// Rule routes the files it matches somewhere other than the dated archive.
+// Rules are evaluated in order; the first matching rule that sets a destination,
+// skips or quarantines decides where the file goes, while the tags of every
+// matching rule are collected.
+type Rule struct {
+	Name   string     `yaml:"name"`
+	Match  RuleMatch  `yaml:"match"`
+	Action RuleAction `yaml:"action"`
+}
+
+// RuleMatch lists the conditions of a rule. All conditions that are set must hold.
+type RuleMatch struct {
+	Make          string        `yaml:"make"`          // Glob, case-insensitive
+	Model         string        `yaml:"model"`         // Glob, case-insensitive
+	Extensions    []string      `yaml:"extensions"`    // e.g. [".png", ".gif"]
+	Filename      string        `yaml:"filename"`      // Glob against the filename
+	FilenameRegex string        `yaml:"filenameRegex"` // Regular expression against the filename
+	MinWidth      int           `yaml:"minWidth"`
+	MaxWidth      int           `yaml:"maxWidth"`
+	MinHeight     int           `yaml:"minHeight"`
+	MaxHeight     int           `yaml:"maxHeight"`
+	MinDuration   time.Duration `yaml:"minDuration"`
+	MaxDuration   time.Duration `yaml:"maxDuration"`
+	HasGPS        *bool         `yaml:"hasGPS"`
+	Screenshot    *bool         `yaml:"screenshot"`
+	TakenAfter    string        `yaml:"takenAfter"`  // YYYY-MM-DD, inclusive
+	TakenBefore   string        `yaml:"takenBefore"` // YYYY-MM-DD, exclusive
+}
+
+// RuleAction is what happens to a file matching a rule
+type RuleAction struct {
+	Destination         string   `yaml:"destination"`         // Destination directory instead of the watch directory's
+	DestinationTemplate string   `yaml:"destinationTemplate"` // Layout below the destination
+	Skip                bool     `yaml:"skip"`                // Leave the file where it is
+	Quarantine          bool     `yaml:"quarantine"`          // Put the file in quarantineDir without a date layout
+	Tags                []string `yaml:"tags"`                // Written to the user.xdg.tags xattr or Finder tags and the state database
+}
+
+// routes reports whether the action decides where a file goes
+func (a RuleAction) routes() bool {
+	return a.Destination != "" || a.DestinationTemplate != "" || a.Skip || a.Quarantine
+}
+
+// route is where a file should go and why
+type route struct {
+	dir        string
+	dateTaken  time.Time // Zero if no date could be found
+	dateSource string    // The date source or fallback that provided dateTaken
+	timeShift  string    // Correction of the camera clock applied to dateTaken, if any
+	tags       []string
+	rule       string // Name of the rule that decided the route, if any
+	skip       string // Reason to leave the file alone, empty to import it
+	why        string // Details of the reason, if any
+	preview    bool   // Write the JPEG preview of a RAW file next to it
+	err        error  // Why the file can't be imported at all, if it can't
+}
+
+// skipNoDate is the skip reason of files that can't be dated, which are tried
+// again according to the failure policy
+const skipNoDate = "no valid date found"
+
+// ruleDateLayout is the format of takenAfter and takenBefore
+const ruleDateLayout = "2006-01-02"
+
+// ruleRegexps caches compiled filenameRegex conditions
+var ruleRegexps sync.Map
+
+// ruleName returns a name for rule i to use in logs
+func ruleName(rule Rule, i int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("rule %d", i+1)
+}
+
+// matches reports whether the file and its metadata meet every condition of m
+func (m RuleMatch) matches(file os.FileInfo, meta mediaMetadata, date_taken time.Time) bool {
+	name := file.Name()
+	if m.Make != "" && !globMatch(m.Make, meta.Make()) {
+		return false
+	}
+	if m.Model != "" && !globMatch(m.Model, meta.Model()) {
+		return false
+	}
+	if len(m.Extensions) > 0 && !hasExtension(name, m.Extensions) {
+		return false
+	}
+	if m.Filename != "" && !globMatch(m.Filename, name) {
+		return false
+	}
+	if m.FilenameRegex != "" {
+		re, err := compileRuleRegex(m.FilenameRegex)
+		if err != nil || !re.MatchString(name) {
+			return false
+		}
+	}
+
+	width, height := meta.Dimensions()
+	if (m.MinWidth > 0 && width < m.MinWidth) || (m.MaxWidth > 0 && width > m.MaxWidth) {
+		return false
+	}
+	if (m.MinHeight > 0 && height < m.MinHeight) || (m.MaxHeight > 0 && height > m.MaxHeight) {
+		return false
+	}
+
+	duration := meta.Duration()
+	if (m.MinDuration > 0 && duration < m.MinDuration) || (m.MaxDuration > 0 && duration > m.MaxDuration) {
+		return false
+	}
+
+	if m.HasGPS != nil && meta.HasGPS() != *m.HasGPS {
+		return false
+	}
+	if m.Screenshot != nil && meta.IsScreenshot(name) != *m.Screenshot {
+		return false
+	}
+
+	if m.TakenAfter != "" || m.TakenBefore != "" {
+		if date_taken.IsZero() {
+			return false
+		}
+		if after, err := time.Parse(ruleDateLayout, m.TakenAfter); err == nil && date_taken.Before(after) {
+			return false
+		}
+		if before, err := time.Parse(ruleDateLayout, m.TakenBefore); err == nil && !date_taken.Before(before) {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch matches name against a case-insensitive glob pattern
+func globMatch(pattern, name string) bool {
+	ok, err := filepath.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return err == nil && ok
+}
+
+// compileRuleRegex compiles a filenameRegex condition once
+func compileRuleRegex(expr string) (*regexp.Regexp, error) {
+	if re, ok := ruleRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	ruleRegexps.Store(expr, re)
+	return re, nil
+}
+
+// routeFile evaluates the rules for a file and works out its route. Without a
+// routing rule the file goes to the dated directory of its watch directory,
+// which needs date_taken; dateErr explains why it is missing. Files without a
+// date go to the undatedDir of the unknownDate policy if one is set.
+func routeFile(settings watchSettings, file os.FileInfo, meta mediaMetadata, date_taken time.Time, dateSource string, dateErr error) route {
+	r := route{dateTaken: date_taken, dateSource: dateSource}
+	var decided *RuleAction
+	for i, rule := range settings.Rules {
+		if !rule.Match.matches(file, meta, date_taken) {
+			continue
+		}
+		r.tags = append(r.tags, rule.Action.Tags...)
+		if rule.Action.routes() && decided == nil {
+			action := rule.Action
+			decided = &action
+			r.rule = ruleName(rule, i)
+		}
+	}
+
+	if decided == nil {
+		if dateErr != nil {
+			r.undated(settings, dateErr.Error())
+			return r
+		}
+		r.dir = datedDir(settings, date_taken)
+		return r
+	}
+
+	switch {
+	case decided.Skip:
+		r.skip, r.why = "skipped by rule", r.rule
+	case decided.Quarantine:
+		r.dir = settings.QuarantineDir
+	default:
+		target := settings
+		if decided.Destination != "" {
+			target.DestinationDir = decided.Destination
+		}
+		if decided.DestinationTemplate != "" {
+			target.DestinationTemplate = decided.DestinationTemplate
+		}
+		if dateErr != nil && templatePlaceholder.MatchString(target.DestinationTemplate) {
+			r.undated(target, fmt.Sprintf("needed by %s: %v", r.rule, dateErr))
+			return r
+		}
+		r.dir = datedDir(target, date_taken)
+	}
+	return r
+}
+
+// undated routes a file without a date to the undatedDir under the destination
+// of settings, or skips it if there is none
+func (r *route) undated(settings watchSettings, why string) {
+	if settings.UnknownDate.UndatedDir == "" {
+		r.skip, r.why = skipNoDate, why
+		return
+	}
+	r.dir = filepath.Join(settings.DestinationDir, filepath.FromSlash(settings.UnknownDate.UndatedDir))
+	r.dateSource = dateUndated
+}
+
+// tagFile writes the tags of r to the imported file. A file manager that
+// doesn't understand them loses nothing, so failures are only logged.
+func tagFile(path string, r route) {
+	if len(r.tags) == 0 {
+		return
+	}
+	if err := writeTags(path, r.tags); err != nil {
+		slog.Warn("Failed to tag file", "path", path, "tags", r.tags, logging.Err(err))
+	}
+}
+
+// checkRules validates the rules of a config
+func checkRules(config Config, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	add := func(line int, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	for i, rule := range config.Rules {
+		name := ruleName(rule, i)
+		if rule.Match.FilenameRegex != "" {
+			if _, err := regexp.Compile(rule.Match.FilenameRegex); err != nil {
+				add(lineOf(root, "rules", i, "match", "filenameRegex"), "invalid filenameRegex in %s: %v", name, err)
+			}
+		}
+		for _, pattern := range []string{rule.Match.Make, rule.Match.Model, rule.Match.Filename} {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				add(lineOf(root, "rules", i, "match"), "invalid glob %q in %s: %v", pattern, name, err)
+			}
+		}
+		for _, key := range []string{"takenAfter", "takenBefore"} {
+			value := rule.Match.TakenAfter
+			if key == "takenBefore" {
+				value = rule.Match.TakenBefore
+			}
+			if _, err := time.Parse(ruleDateLayout, value); value != "" && err != nil {
+				add(lineOf(root, "rules", i, "match", key), "%s in %s must be a YYYY-MM-DD date", key, name)
+			}
+		}
+		if err := checkTemplate(rule.Action.DestinationTemplate); err != nil {
+			add(lineOf(root, "rules", i, "action", "destinationTemplate"), "%v", err)
+		}
+		if rule.Action.Skip && rule.Action.Quarantine {
+			add(lineOf(root, "rules", i, "action"), "%s can't both skip and quarantine", name)
+		}
+		if rule.Action.Quarantine && config.QuarantineDir == "" {
+			add(lineOf(root, "rules", i, "action", "quarantine"), "%s quarantines files but quarantineDir is not set", name)
+		}
+		if !rule.Action.routes() && len(rule.Action.Tags) == 0 {
+			add(lineOf(root, "rules", i, "action"), "%s has no action", name)
+		}
+		if rule.Action.Destination != "" {
+			problems = append(problems, checkDestinationOverlap(config, rule.Action.Destination, lineOf(root, "rules", i, "action", "destination"))...)
+		}
+	}
+	if config.QuarantineDir != "" {
+		problems = append(problems, checkDestinationOverlap(config, config.QuarantineDir, lineOf(root, "quarantineDir"))...)
+	}
+	return problems
+}
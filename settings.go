@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"movephoto/dates"
+	"movephoto/filter"
+)
+
+// defaultMinFileSize is the minimum file size in bytes (100KB) used when the config doesn't set one
+const defaultMinFileSize = int64(102400)
+
+// defaultDestinationTemplate reproduces the original YYYY/MM - Month/YYYY-MM-DD layout
+const defaultDestinationTemplate = "{year}/{month} - {monthName}/{year}-{month}-{day}"
+
+// watchSettings are the effective settings for one watch directory, with
+// everything it doesn't override inherited from the top level of the config
+type watchSettings struct {
+	Path                string
+	Action              string
+	Filter              *filter.Filter // Nil when no patterns are configured
+	DestinationDir      string
+	DestinationTemplate string
+	RawTemplate         string // DestinationTemplate of RAW files
+	RawPreviews         bool
+	ImageExtensions     []string // Without the RAW extensions
+	VideoExtensions     []string
+	RawExtensions       []string
+	BannedExtensions    []string
+	Photos              mediaLimits
+	Videos              mediaLimits
+	Rules               []Rule
+	QuarantineDir       string
+	UnknownDate         UnknownDatePolicy
+	DateSources         DateSources
+	DateWindow          dates.Window
+	TimeShifts          []dates.TimeShift
+}
+
+// mediaLimits are the effective MediaLimits for one media type
+type mediaLimits struct {
+	MinFileSize  int64
+	MaxFileSize  int64 // 0 means no limit
+	MinDimension int
+	MinDuration  time.Duration
+}
+
+// override returns l with every limit set in o replaced
+func (l mediaLimits) override(o MediaLimits) mediaLimits {
+	if o.MinFileSize != nil {
+		l.MinFileSize = *o.MinFileSize
+	}
+	if o.MaxFileSize != nil {
+		l.MaxFileSize = *o.MaxFileSize
+	}
+	if o.MinDimension != nil {
+		l.MinDimension = *o.MinDimension
+	}
+	if o.MinDuration != nil {
+		l.MinDuration = *o.MinDuration
+	}
+	return l
+}
+
+// check returns why a file with metadata meta is below the limits, or an empty
+// reason. Files whose dimensions or duration are unknown pass.
+func (l mediaLimits) check(meta mediaMetadata) (string, string) {
+	if l.MinDimension > 0 {
+		width, height := meta.Dimensions()
+		if width > 0 && height > 0 && (width < l.MinDimension || height < l.MinDimension) {
+			return "too few pixels", fmt.Sprintf("%dx%d", width, height)
+		}
+	}
+	if l.MinDuration > 0 {
+		if duration := meta.Duration(); duration > 0 && duration < l.MinDuration {
+			return "too short", duration.String()
+		}
+	}
+	return "", ""
+}
+
+// resolveWatchDir merges the overrides of watchDir over the top-level config
+func resolveWatchDir(config Config, watchDir WatchDir) watchSettings {
+	settings := watchSettings{
+		Path:                watchDir.Path,
+		Action:              watchDir.Action,
+		DestinationDir:      config.DefaultDestinationDir,
+		DestinationTemplate: config.DestinationTemplate,
+		RawTemplate:         config.RawDestinationTemplate,
+		RawPreviews:         config.RawPreviews,
+		ImageExtensions:     config.ImageExtensions,
+		VideoExtensions:     config.VideoExtensions,
+		RawExtensions:       config.RawExtensions,
+		BannedExtensions:    config.BannedExtensions,
+		Rules:               config.Rules,
+		QuarantineDir:       config.QuarantineDir,
+		UnknownDate:         config.UnknownDate,
+		DateSources:         config.DateSources,
+		DateWindow:          config.DateSources.window(),
+		TimeShifts:          config.TimeShifts,
+	}
+
+	if watchDir.Destination != "" {
+		settings.DestinationDir = watchDir.Destination
+	}
+	if watchDir.DestinationTemplate != "" {
+		settings.DestinationTemplate = watchDir.DestinationTemplate
+	}
+	if watchDir.ImageExtensions != nil {
+		settings.ImageExtensions = watchDir.ImageExtensions
+	}
+	if watchDir.VideoExtensions != nil {
+		settings.VideoExtensions = watchDir.VideoExtensions
+	}
+	if watchDir.RawExtensions != nil {
+		settings.RawExtensions = watchDir.RawExtensions
+	}
+	if watchDir.RawDestinationTemplate != "" {
+		settings.RawTemplate = watchDir.RawDestinationTemplate
+	}
+	if watchDir.BannedExtensions != nil {
+		settings.BannedExtensions = watchDir.BannedExtensions
+	}
+	if watchDir.UnknownDate != nil {
+		settings.UnknownDate = *watchDir.UnknownDate
+	}
+
+	// The most specific limit wins: the media type of the watch directory,
+	// the watch directory, the media type at the top level, the top level
+	base := mediaLimits{MinFileSize: defaultMinFileSize}.override(MediaLimits{MinFileSize: config.MinFileSize, MaxFileSize: &config.MaxFileSize})
+	watchLimits := MediaLimits{MinFileSize: watchDir.MinFileSize, MaxFileSize: watchDir.MaxFileSize}
+	settings.Photos = base.override(config.Photos).override(watchLimits).override(watchDir.Photos)
+	settings.Videos = base.override(config.Videos).override(watchLimits).override(watchDir.Videos)
+
+	if settings.DestinationTemplate == "" {
+		settings.DestinationTemplate = defaultDestinationTemplate
+	}
+	if settings.RawTemplate == "" {
+		settings.RawTemplate = settings.DestinationTemplate
+	}
+
+	// RAW formats listed as images too are imported as RAW files
+	var images []string
+	for _, ext := range settings.ImageExtensions {
+		if !hasExtension("x"+ext, settings.RawExtensions) {
+			images = append(images, ext)
+		}
+	}
+	settings.ImageExtensions = images
+
+	// Invalid patterns were already rejected by checkConfig
+	include, exclude := watchPatterns(config, watchDir)
+	settings.Filter, _ = filter.New(include, exclude)
+	return settings
+}
+
+// raw returns the settings for the RAW files of the watch directory
+func (s watchSettings) raw() watchSettings {
+	s.DestinationTemplate = s.RawTemplate
+	return s
+}
+
+// watchPatterns returns the include and exclude patterns of watchDir, with the
+// deprecated includePrefix translated to globs
+func watchPatterns(config Config, watchDir WatchDir) ([]string, []string) {
+	include, exclude := config.IncludePatterns, config.ExcludePatterns
+	if watchDir.IncludePatterns != nil {
+		include = watchDir.IncludePatterns
+	}
+	if watchDir.ExcludePatterns != nil {
+		exclude = watchDir.ExcludePatterns
+	}
+	if len(watchDir.IncludePrefix) > 0 {
+		include = append(append([]string(nil), include...), filter.PrefixPatterns(watchDir.IncludePrefix)...)
+	}
+	return include, exclude
+}
+
+// destinationDirs returns every destination directory used by the config
+func destinationDirs(config Config) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	add(config.DefaultDestinationDir)
+	for _, watchDir := range config.WatchDirs {
+		add(watchDir.Destination)
+	}
+	add(config.QuarantineDir)
+	for _, rule := range config.Rules {
+		add(rule.Action.Destination)
+	}
+	return dirs
+}
+
+// templatePlaceholder matches the {name} placeholders of a destination template
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// templateValues returns the value of every supported placeholder for date_taken
+func templateValues(date_taken time.Time) map[string]string {
+	year_taken, month_taken, day_taken := date_taken.Date()
+	return map[string]string{
+		"year":      fmt.Sprintf("%04d", year_taken),
+		"month":     fmt.Sprintf("%02d", int(month_taken)),
+		"monthName": month_taken.String(),
+		"day":       fmt.Sprintf("%02d", day_taken),
+		"hour":      fmt.Sprintf("%02d", date_taken.Hour()),
+		"minute":    fmt.Sprintf("%02d", date_taken.Minute()),
+		"second":    fmt.Sprintf("%02d", date_taken.Second()),
+	}
+}
+
+// expandTemplate fills in the placeholders of a destination template. The
+// template uses forward slashes as separators on every platform.
+func expandTemplate(template string, date_taken time.Time) string {
+	values := templateValues(date_taken)
+	expanded := templatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return values[strings.Trim(placeholder, "{}")]
+	})
+	return filepath.FromSlash(expanded)
+}
+
+// checkTemplate returns an error naming the first unknown placeholder in template
+func checkTemplate(template string) error {
+	values := templateValues(time.Time{})
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if _, ok := values[m[1]]; !ok {
+			return fmt.Errorf("unknown placeholder {%s} in destination template %q", m[1], template)
+		}
+	}
+	if filepath.IsAbs(filepath.FromSlash(template)) || strings.Contains(template, "..") {
+		return fmt.Errorf("destination template %q must be a relative path inside the destination", template)
+	}
+	return nil
+}
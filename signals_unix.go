@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	shutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	reloadSignals   = []os.Signal{syscall.SIGHUP}
+	scanSignals     = []os.Signal{syscall.SIGUSR1}
+)
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+)
+
+var (
+	shutdownSignals = []os.Signal{os.Interrupt}
+	reloadSignals   = []os.Signal{}
+	scanSignals     = []os.Signal{}
+)
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"movephoto/logging"
+)
+
+// importRecord describes one file that was written to the destination
+type importRecord struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Size        int64     `json:"size"`
+	Algorithm   string    `json:"algorithm,omitempty"` // Empty when no checksum was computed, e.g. for renames
+	Checksum    string    `json:"checksum,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`       // Collected from the matching rules
+	Rule        string    `json:"rule,omitempty"`       // Rule that routed the file, if any
+	DateSource  string    `json:"dateSource,omitempty"` // The date source or fallback that dated the file, or undated
+	TimeShift   string    `json:"timeShift,omitempty"`  // Correction of the camera clock in the date, if any
+	MovedFrom   string    `json:"movedFrom,omitempty"`  // Earlier destination of a file moved by timeshift
+	Preview     string    `json:"preview,omitempty"`    // JPEG preview written next to a RAW file, if any
+	ImportedAt  time.Time `json:"importedAt"`
+}
+
+// stateDB is an append-only JSON lines log of imports kept next to the archive.
+// The checksums let later integrity checks compare the archive against what
+// was originally copied.
+type stateDB struct {
+	mu      sync.Mutex
+	path    string
+	imports map[string]importRecord // Keyed by destination path
+}
+
+// Global state database
+var state *stateDB
+
+// openState loads the processed files list, the state database and the
+// failure list kept in the destination directory
+func openState(destinationDir string) {
+	processedFilesMu.Lock()
+	defer processedFilesMu.Unlock()
+
+	// Set the path for processed_files.txt under the destination directory
+	processedFilesPath = filepath.Join(destinationDir, "processed_files.txt")
+
+	// Load processed files
+	processedFiles = loadProcessedFiles(processedFilesPath)
+
+	// Load the state database with the checksums of earlier imports
+	state = loadState(filepath.Join(destinationDir, "movephoto_state.jsonl"))
+
+	// Load the attempt counts of files that failed before
+	failures.open(filepath.Join(destinationDir, "movephoto_failures.json"))
+}
+
+// loadState reads the state database at path, returning an empty one if it doesn't exist yet
+func loadState(path string) *stateDB {
+	db := &stateDB{
+		path:    path,
+		imports: make(map[string]importRecord),
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db
+		}
+		logging.Fatal("Error opening state database", "path", path, logging.Err(err))
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record importRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn last line from a crash shouldn't stop the importer
+			slog.Warn("Ignoring unreadable state database entry", "path", path, logging.Err(err))
+			continue
+		}
+		delete(db.imports, record.MovedFrom)
+		db.imports[record.Destination] = record
+	}
+	if err := scanner.Err(); err != nil {
+		logging.Fatal("Error reading state database", "path", path, logging.Err(err))
+	}
+	return db
+}
+
+// recordImport appends an import to the state database
+func (db *stateDB) recordImport(record importRecord) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if record.ImportedAt.IsZero() {
+		record.ImportedAt = time.Now()
+	}
+	delete(db.imports, record.MovedFrom)
+	db.imports[record.Destination] = record
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Failed to encode state database entry", logging.Err(err))
+		return
+	}
+
+	// Ensure the directory exists
+	if err := os.MkdirAll(filepath.Dir(db.path), os.ModePerm); err != nil {
+		slog.Error("Failed to create state database directory", "path", db.path, logging.Err(err))
+		return
+	}
+
+	file, err := os.OpenFile(db.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("Failed to open state database", "path", db.path, logging.Err(err))
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write to state database", "path", db.path, logging.Err(err))
+	}
+}
+
+// sync flushes the state database to disk
+func (db *stateDB) sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return syncFile(db.path)
+}
+
+// flushState makes sure everything recorded so far has reached the disk
+func flushState() {
+	if state != nil {
+		if err := state.sync(); err != nil {
+			slog.Error("Failed to sync state database", "path", state.path, logging.Err(err))
+		}
+	}
+
+	processedFilesMu.Lock()
+	defer processedFilesMu.Unlock()
+	if err := syncFile(processedFilesPath); err != nil {
+		slog.Error("Failed to sync processed files list", "path", processedFilesPath, logging.Err(err))
+	}
+}
+
+// syncFile fsyncs the file at path if it exists
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"movephoto/report"
+)
+
+// maxRecent is how many recent imports are kept for the API
+const maxRecent = 200
+
+// queuedFile is a file whose destination has been claimed and that is waiting
+// for or in transfer
+type queuedFile struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Started     bool   `json:"started"`
+}
+
+// deferredFile is a file the current or last scan left in the watch directory
+type deferredFile struct {
+	Source  string `json:"source"`
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+// serviceStatus is what the running importer knows about its own work, as
+// reported by the API. It lives in memory only.
+type serviceStatus struct {
+	mu           sync.Mutex
+	config       Config // Config of the watch loop, including pending reloads once applied
+	scanning     bool
+	scanStarted  time.Time
+	scanFinished time.Time
+	paused       map[string]bool // Watch directory paths
+	imports      []importRecord  // Oldest first, at most maxRecent
+	queued       map[string]queuedFile
+	deferred     map[string]deferredFile
+	scans        chan struct{} // Scan requests for the watch loop
+}
+
+// Global status of the importer
+var status = &serviceStatus{
+	paused:   make(map[string]bool),
+	queued:   make(map[string]queuedFile),
+	deferred: make(map[string]deferredFile),
+	scans:    make(chan struct{}, 1),
+}
+
+// setConfig records the config the watch loop currently uses
+func (s *serviceStatus) setConfig(config Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// currentConfig returns the config the watch loop currently uses
+func (s *serviceStatus) currentConfig() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// startScan marks the start of a scan and forgets the files deferred by the last one
+func (s *serviceStatus) startScan() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scanning = true
+	s.scanStarted = time.Now()
+	s.deferred = make(map[string]deferredFile)
+}
+
+// finishScan marks the end of a scan
+func (s *serviceStatus) finishScan() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scanning = false
+	s.scanFinished = time.Now()
+}
+
+// requestScan asks the watch loop for a scan. Requests made while one is
+// already waiting are merged.
+func (s *serviceStatus) requestScan() {
+	select {
+	case s.scans <- struct{}{}:
+	default:
+	}
+}
+
+// setPaused pauses or resumes the watch directory at path
+func (s *serviceStatus) setPaused(path string, paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if paused {
+		s.paused[path] = true
+	} else {
+		delete(s.paused, path)
+	}
+}
+
+// isPaused reports whether the watch directory at path is paused
+func (s *serviceStatus) isPaused(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused[path]
+}
+
+// pausedDirs returns the paused watch directories in sorted order
+func (s *serviceStatus) pausedDirs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirs := make([]string, 0, len(s.paused))
+	for dir := range s.paused {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// addImport remembers an imported file
+func (s *serviceStatus) addImport(record importRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record.ImportedAt.IsZero() {
+		record.ImportedAt = time.Now()
+	}
+	s.imports = append(s.imports, record)
+	if len(s.imports) > maxRecent {
+		s.imports = append([]importRecord(nil), s.imports[len(s.imports)-maxRecent:]...)
+	}
+}
+
+// recentImports returns up to limit imports, newest first
+func (s *serviceStatus) recentImports(limit int) []importRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit <= 0 || limit > len(s.imports) {
+		limit = len(s.imports)
+	}
+	imports := make([]importRecord, 0, limit)
+	for i := len(s.imports) - 1; i >= len(s.imports)-limit; i-- {
+		imports = append(imports, s.imports[i])
+	}
+	return imports
+}
+
+// queue marks c as waiting for transfer
+func (s *serviceStatus) queue(c *candidate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued[c.path] = queuedFile{Source: c.path, Destination: c.fullDestination}
+}
+
+// startTransfer marks the transfer of c as started
+func (s *serviceStatus) startTransfer(c *candidate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued[c.path] = queuedFile{Source: c.path, Destination: c.fullDestination, Started: true}
+}
+
+// dequeue forgets c once its transfer is over, whatever the outcome
+func (s *serviceStatus) dequeue(c *candidate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.queued, c.path)
+}
+
+// deferFile remembers a file the scan left alone for reason
+func (s *serviceStatus) deferFile(path, reason, details string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deferred[path] = deferredFile{Source: path, Reason: reason, Details: details}
+}
+
+// pendingFiles returns the queued files and the deferred files, sorted by source
+func (s *serviceStatus) pendingFiles() ([]queuedFile, []deferredFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := make([]queuedFile, 0, len(s.queued))
+	for _, f := range s.queued {
+		queued = append(queued, f)
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].Source < queued[j].Source })
+	deferred := make([]deferredFile, 0, len(s.deferred))
+	for _, f := range s.deferred {
+		deferred = append(deferred, f)
+	}
+	sort.Slice(deferred, func(i, j int) bool { return deferred[i].Source < deferred[j].Source })
+	return queued, deferred
+}
+
+// snapshot returns the scan state for the health endpoint
+func (s *serviceStatus) snapshot() (scanning bool, started, finished time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scanning, s.scanStarted, s.scanFinished
+}
+
+// watchDirOf returns the watch directory a candidate file was found in
+func watchDirOf(path string) string {
+	return filepath.Dir(path)
+}
+
+// countSkipped records a file left alone for reason in the summary, the
+// metrics and the status
+func countSkipped(path, reason, details string) {
+	summary.Skip(reason)
+	filesSkipped.WithLabelValues(watchDirOf(path), reason).Inc()
+	status.deferFile(path, reason, details)
+}
+
+// countImported records an imported file; copied is the number of bytes written
+func countImported(record importRecord, action string, copied int64) {
+	watchDir := watchDirOf(record.Source)
+	summary.Add("imported", copied)
+	filesImported.WithLabelValues(watchDir, action).Inc()
+	bytesCopied.WithLabelValues(watchDir).Add(float64(copied))
+	status.addImport(record)
+	failures.forget(record.Source)
+	hooks.fileEvent(eventPostImport, hookFile{
+		Source:      record.Source,
+		Destination: record.Destination,
+		Size:        record.Size,
+		Action:      action,
+		Checksum:    record.Checksum,
+		Tags:        record.Tags,
+		Rule:        record.Rule,
+		DateSource:  record.DateSource,
+	})
+}
+
+// countFailed records a file that failed to import; moveMode tells whether
+// the source may be moved aside once it keeps failing
+func countFailed(source, destination, action string, moveMode bool, err error) {
+	summary.Fail(report.Failure{Source: source, Destination: destination, Action: action, Error: err.Error()})
+	filesFailed.WithLabelValues(watchDirOf(source), action).Inc()
+	trackFailure(source, action, err.Error(), moveMode)
+	hooks.fileEvent(eventError, hookFile{Source: source, Destination: destination, Action: action, Error: err.Error()})
+}
+
+// countCollision records a file whose destination name was already taken
+func countCollision(path, reason, destination string) {
+	destinationCollisions.WithLabelValues(watchDirOf(path)).Inc()
+	countSkipped(path, reason, destination)
+}
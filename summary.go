@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"movephoto/logging"
+	"movephoto/report"
+)
+
+// Global report of the current scan
+var summary = report.New("movephoto", "imported", "failed")
+
+// reportScan logs the summary and the failures of the scan that just ended
+// and writes its report to reportsDir. Uneventful scans are only logged at
+// debug level and get no report file.
+func reportScan(config Config, eventful bool) {
+	level := slog.LevelDebug
+	if eventful {
+		level = slog.LevelInfo
+	}
+	slog.Log(context.Background(), level, "Scan summary", "summary", summary.String(), "bytes", summary.TotalBytes(), "duration", summary.Elapsed())
+	for _, f := range summary.FailureList() {
+		slog.Warn("Failed file", "source", f.Source, "destination", f.Destination, "action", f.Action, "error", f.Error)
+	}
+
+	if config.ReportsDir == "" || !eventful {
+		return
+	}
+	path, err := summary.Write(config.ReportsDir, config.HTMLReports)
+	if err != nil {
+		slog.Error("Failed to write report", "dir", config.ReportsDir, logging.Err(err))
+		return
+	}
+	slog.Debug("Wrote report", "path", path)
+}
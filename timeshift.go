@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"movephoto/dates"
+	"movephoto/logging"
+)
+
+// checkTimeShifts validates the timeShifts of config
+func checkTimeShifts(config Config, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	for i, t := range config.TimeShifts {
+		if t.Make == "" && t.Model == "" && t.Serial == "" {
+			problems = append(problems, configProblem{Line: lineOf(root, "timeShifts", i), Message: "time shift needs a make, model or serial"})
+		}
+		if _, err := dates.ParseShift(t.Shift); err != nil {
+			problems = append(problems, configProblem{Line: lineOf(root, "timeShifts", i, "shift"), Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// shiftExif shifts the dates in the metadata of path by shift with ExifTool,
+// which can only shift in one direction at a time
+func shiftExif(path string, shift dates.Shift) error {
+	op := "+="
+	switch forward, back := shift.Signs(); {
+	case forward && back:
+		return fmt.Errorf("can't rewrite the metadata with shift %s, it has to move every part in the same direction", shift)
+	case back:
+		op = "-="
+		shift = shift.Negate()
+	}
+	seconds := int(shift.Clock / time.Second)
+	value := fmt.Sprintf("%d:%d:%d %d:%d:%d", shift.Years, shift.Months, shift.Days, seconds/3600, seconds%3600/60, seconds%60)
+	cmd := exec.Command("exiftool", "-q", "-q", "-overwrite_original", "-P",
+		"-AllDates"+op+value, "-MediaCreateDate"+op+value, "-MediaModifyDate"+op+value, path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("exiftool: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// settingsForSource returns the settings of the watch directory source was imported from
+func settingsForSource(config Config, source string) watchSettings {
+	for _, watchDir := range config.WatchDirs {
+		if filepath.Clean(watchDir.Path) == filepath.Dir(source) {
+			return resolveWatchDir(config, watchDir)
+		}
+	}
+	return resolveWatchDir(config, WatchDir{Path: filepath.Dir(source)})
+}
+
+// runTimeshiftCommand applies a time shift to the files of a camera that were
+// already imported, moving them to the folder of their corrected date, and
+// returns the exit code
+func runTimeshiftCommand(args []string) int {
+	flags := flag.NewFlagSet("timeshift", flag.ContinueOnError)
+	shiftFlag := flags.String("shift", "", "Correction to apply, e.g. +1h, -30m or +1y2mo3d")
+	makeFlag := flags.String("make", "", "Only shift files of cameras of this make")
+	modelFlag := flags.String("model", "", "Only shift files of this camera model")
+	serialFlag := flags.String("serial", "", "Only shift files of the camera with this serial number")
+	writeExif := flags.Bool("write-exif", false, "Also rewrite the dates in the metadata of the files with ExifTool")
+	dryRun := flags.Bool("dry-run", false, "Only show what would be moved")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: movephoto [flags] timeshift -shift SHIFT [-make MAKE] [-model MODEL] [-serial SERIAL] [-write-exif] [-dry-run]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	shift, err := dates.ParseShift(*shiftFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if shift.IsZero() {
+		fmt.Fprintln(os.Stderr, "timeshift needs a -shift other than zero")
+		return 2
+	}
+	if forward, back := shift.Signs(); *writeExif && forward && back {
+		fmt.Fprintln(os.Stderr, "-write-exif needs a -shift that moves every part in the same direction")
+		return 2
+	}
+	camera := dates.TimeShift{Make: *makeFlag, Model: *modelFlag, Serial: *serialFlag}
+	if camera.Make == "" && camera.Model == "" && camera.Serial == "" {
+		fmt.Fprintln(os.Stderr, "timeshift needs a -make, -model or -serial to pick the camera")
+		flags.Usage()
+		return 2
+	}
+
+	if *debug {
+		logOptions.Level = "debug"
+	}
+	closeLog, err := logging.Setup(*logOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	defer closeLog()
+
+	config, err := readConfig(*configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if config.LockFilePath != "" && !*dryRun {
+		lock, err := acquireLock(config.LockFilePath, *lockTimeout)
+		if err != nil {
+			slog.Error("Another instance is already running", logging.Err(err))
+			return 1
+		}
+		defer lock.release()
+	}
+	openState(config.DefaultDestinationDir)
+	useMetadataBackend(config.MetadataBackend)
+	opts := newTransferOptions(config)
+
+	state.mu.Lock()
+	records := make([]importRecord, 0, len(state.imports))
+	for _, record := range state.imports {
+		records = append(records, record)
+	}
+	state.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Destination < records[j].Destination })
+
+	shifted, failed := 0, 0
+	for _, record := range records {
+		ok, err := timeshiftFile(config, opts, record, camera, shift, *writeExif, *dryRun)
+		if err != nil {
+			slog.Error("Failed to shift file", "source", record.Destination, logging.Err(err))
+			failed++
+		} else if ok {
+			shifted++
+		}
+	}
+	if *dryRun {
+		slog.Info("Time shift summary", "wouldShift", shifted, "failed", failed)
+	} else {
+		slog.Info("Time shift summary", "shifted", shifted, "failed", failed)
+	}
+	flushState()
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// timeshiftFile applies shift to the imported file of record if it was taken
+// by camera and dated by its clock, reporting whether it did
+func timeshiftFile(config Config, opts transferOptions, record importRecord, camera dates.TimeShift, shift dates.Shift, writeExif, dryRun bool) (bool, error) {
+	path := record.Destination
+	info, err := os.Stat(path)
+	if err != nil {
+		slog.Debug("Skipping imported file", "source", path, "reason", "missing")
+		return false, nil
+	}
+	meta, err := readMetadata(path)
+	if err != nil {
+		slog.Debug("Skipping imported file", "source", path, "reason", "unreadable metadata", logging.Err(err))
+		return false, nil
+	}
+	if !camera.Matches(meta) {
+		return false, nil
+	}
+
+	settings := settingsForSource(config, record.Source)
+	sources := settings.DateSources.Photos
+	if hasExtension(path, settings.VideoExtensions) {
+		sources = settings.DateSources.Videos
+	} else if hasExtension(path, settings.RawExtensions) {
+		settings = settings.raw()
+	}
+	var applied dates.Shift
+	if record.TimeShift != "" {
+		if applied, err = dates.ParseShift(record.TimeShift); err != nil {
+			return false, err
+		}
+	}
+	date, source, err := dateTaken(settings, sources, meta, applied, path, info)
+	if err != nil || !dates.CameraClock(source) {
+		slog.Debug("Skipping imported file", "source", path, "reason", "not dated by the camera clock")
+		return false, nil
+	}
+	if record.Rule != "" {
+		slog.Warn("Skipping imported file routed by a rule, move it by hand", "source", path, "rule", record.Rule)
+		return false, nil
+	}
+
+	date = shift.Apply(date)
+	destination := filepath.Join(datedDir(settings, date), filepath.Base(path))
+	if dryRun {
+		slog.Info("Would shift file", "source", path, "destination", destination, "shift", shift.String(), "date", date)
+		return true, nil
+	}
+
+	updated := record
+	if writeExif {
+		// The metadata now holds the new shift, the one applied at import
+		// still goes on top
+		if err := shiftExif(path, shift); err != nil {
+			return false, err
+		}
+		if record.Algorithm != "" {
+			if updated.Checksum, err = computeFileChecksum(path, record.Algorithm); err != nil {
+				return false, err
+			}
+		}
+		if info, err := os.Stat(path); err == nil {
+			updated.Size = info.Size()
+		}
+	} else if total := applied.Plus(shift); total.IsZero() {
+		updated.TimeShift = ""
+	} else {
+		updated.TimeShift = total.String()
+	}
+	if destination != path {
+		if err := os.MkdirAll(filepath.Dir(destination), os.ModePerm); err != nil {
+			return false, err
+		}
+		if err := renameNoClobber(path, destination, opts, date); err != nil {
+			return false, err
+		}
+		updated.Destination = destination
+		updated.MovedFrom = path
+		if record.Preview != "" {
+			// The preview goes along, but the RAW file is what matters
+			preview := previewPath(destination)
+			if err := renameNoClobber(record.Preview, preview, opts, date); err != nil {
+				slog.Warn("Failed to move preview", "source", record.Preview, "destination", preview, logging.Err(err))
+			} else {
+				updated.Preview = preview
+			}
+		}
+	}
+	state.recordImport(updated)
+	slog.Info("Shifted file", "source", path, "destination", destination, "shift", shift.String(), "date", date)
+	return true, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"movephoto/dates"
+)
+
+// Date sources recorded with imports besides those of the dates package
+const (
+	dateFromNeighbours = "neighbours" // The date of a neighbouring file
+	dateUndated        = "undated"    // Nothing dated the file, it went to undatedDir
+)
+
+// UnknownDatePolicy decides what happens to files none of the date sources
+// give a believable date
+type UnknownDatePolicy struct {
+	Fallbacks  []string `yaml:"fallbacks"`  // Tried in order: folderName, neighbours and/or mtime
+	UndatedDir string   `yaml:"undatedDir"` // Relative to the destination, for files no fallback dates. Empty leaves them in place
+}
+
+// neighbourDistance is how many files before and after an undated file are
+// looked at for the neighbours fallback
+const neighbourDistance = 3
+
+// fallbackDate dates filePath by the fallbacks of policy, returning the date
+// and the fallback that provided it
+func fallbackDate(settings watchSettings, policy UnknownDatePolicy, filePath string, file os.FileInfo) (time.Time, string, error) {
+	for _, fallback := range policy.Fallbacks {
+		var date time.Time
+		var ok bool
+		if fallback == dateFromNeighbours {
+			date, ok = neighbourDate(settings, filePath)
+		} else {
+			date, ok = dates.Date(fallback, dates.File{Path: filePath, ModTime: file.ModTime()})
+		}
+		if ok && settings.DateWindow.Check(date) == nil {
+			slog.Info("Using fallback date", "source", filePath, "dateSource", fallback, "date", date.Format(time.DateOnly))
+			return date, fallback, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("no date found by the date sources or fallbacks")
+}
+
+// neighbourDates caches the dates of neighbouring files by path, size and
+// modification time, since one file is the neighbour of several
+var neighbourDates sync.Map
+
+// neighbourKey identifies a version of a file in neighbourDates
+type neighbourKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// neighbourDate returns the date of the closest file before or after filePath
+// in name order that is dated by its date sources. Earlier files win
+// ties, as cameras number their shots in order.
+func neighbourDate(settings watchSettings, filePath string) (time.Time, bool) {
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var shots []os.DirEntry
+	index := -1
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !(hasExtension(name, settings.ImageExtensions) || hasExtension(name, settings.RawExtensions) || hasExtension(name, settings.VideoExtensions)) {
+			continue
+		}
+		if name == filepath.Base(filePath) {
+			index = len(shots)
+		}
+		shots = append(shots, entry)
+	}
+	if index < 0 {
+		return time.Time{}, false
+	}
+
+	for distance := 1; distance <= neighbourDistance; distance++ {
+		for _, i := range []int{index - distance, index + distance} {
+			if i < 0 || i >= len(shots) {
+				continue
+			}
+			if date, ok := shotDate(settings, filepath.Join(filepath.Dir(filePath), shots[i].Name()), shots[i]); ok {
+				return date, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// shotDate returns the date of a neighbouring file from its date sources
+func shotDate(settings watchSettings, path string, entry os.DirEntry) (time.Time, bool) {
+	info, err := entry.Info()
+	if err != nil {
+		return time.Time{}, false
+	}
+	key := neighbourKey{path: path, size: info.Size(), modTime: info.ModTime()}
+	if cached, ok := neighbourDates.Load(key); ok {
+		date := cached.(time.Time)
+		return date, !date.IsZero()
+	}
+
+	sources := settings.DateSources.Photos
+	if hasExtension(entry.Name(), settings.VideoExtensions) {
+		sources = settings.DateSources.Videos
+	}
+	meta, _ := readMetadata(path)
+	date, _, err := dateTaken(settings, sources, meta, dates.CameraShift(settings.TimeShifts, meta), path, info)
+	if err != nil {
+		date = time.Time{}
+	}
+	neighbourDates.Store(key, date)
+	return date, !date.IsZero()
+}
+
+// checkUnknownDate validates the unknownDate policy found at path in the config
+func checkUnknownDate(policy UnknownDatePolicy, root *yaml.Node, path ...interface{}) []configProblem {
+	var problems []configProblem
+	at := func(steps ...interface{}) int {
+		return lineOf(root, append(append([]interface{}(nil), path...), steps...)...)
+	}
+	for i, fallback := range policy.Fallbacks {
+		switch fallback {
+		case dates.FolderName, dateFromNeighbours, dates.Mtime:
+		default:
+			problems = append(problems, configProblem{Line: at("fallbacks", i), Message: fmt.Sprintf("unknown date fallback %q, expected folderName, neighbours or mtime", fallback)})
+		}
+	}
+	if filepath.IsAbs(filepath.FromSlash(policy.UndatedDir)) || strings.Contains(policy.UndatedDir, "..") {
+		problems = append(problems, configProblem{Line: at("undatedDir"), Message: fmt.Sprintf("undatedDir %q must be a relative path inside the destination", policy.UndatedDir)})
+	}
+	return problems
+}
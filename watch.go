@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+
+	"movephoto/logging"
+)
+
+// run performs a single scan, or keeps scanning every polling interval in
+// watch mode, until it is done or told to stop. SIGTERM and SIGINT stop new
+// files from being started and give in-flight ones until -shutdown-timeout to
+// finish. In watch mode the config file is reloaded when it changes on disk or
+// on the reload signal (SIGHUP), and the scan signal (SIGUSR1) or a request to
+// the API starts a scan straight away. It returns the process exit code.
+func run(config Config, watchMode bool) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(append(shutdownSignals, reloadSignals...), scanSignals...)...)
+	defer signal.Stop(signals)
+
+	scanDone := make(chan struct{})
+	scanning := false
+
+	// Each scan works on its own copy of the config. A reloaded config is
+	// swapped in between scans so a running scan never sees a mix of both.
+	stamp := statConfig(*configFilePath)
+	var pendingConfig *Config
+	swapConfig := func(newConfig Config) {
+		if scanning {
+			pendingConfig = &newConfig
+			return
+		}
+		config = applyConfig(config, newConfig)
+		status.setConfig(config)
+	}
+	startScan := func() {
+		if scanning {
+			slog.Debug("Scan already in progress")
+			return
+		}
+		scanning = true
+		go func(config Config) {
+			processFiles(ctx, config)
+			scanDone <- struct{}{}
+		}(config)
+	}
+
+	var tick <-chan time.Time
+	if watchMode {
+		status.setConfig(config)
+		if config.APIAddress != "" {
+			serve("API", config.APIAddress, apiHandler(config.MetricsAddress == config.APIAddress))
+		}
+		if config.MetricsAddress != "" && config.MetricsAddress != config.APIAddress {
+			serveMetrics(config.MetricsAddress)
+		}
+		slog.Debug("Starting regular scanning of source directories", "interval", time.Duration(*pollingInterval)*time.Second)
+		ticker := time.NewTicker(time.Duration(*pollingInterval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	} else {
+		slog.Debug("Performing a single scan")
+		startScan()
+	}
+
+	for {
+		select {
+		case <-scanDone:
+			scanning = false
+			if !watchMode {
+				flushState()
+				return 0
+			}
+			if pendingConfig != nil {
+				config = applyConfig(config, *pendingConfig)
+				status.setConfig(config)
+				pendingConfig = nil
+			}
+
+		case <-tick:
+			if newStamp := statConfig(*configFilePath); newStamp != stamp {
+				stamp = newStamp
+				if newConfig, ok := reloadConfig("config file changed"); ok {
+					swapConfig(newConfig)
+				}
+			}
+			slog.Debug("Polling for new files")
+			startScan()
+
+		case sig := <-signals:
+			switch {
+			case containsSignal(shutdownSignals, sig):
+				slog.Info("Shutting down", "signal", sig.String())
+				cancel()
+				return shutdown(scanning, scanDone)
+
+			case containsSignal(reloadSignals, sig):
+				stamp = statConfig(*configFilePath)
+				if newConfig, ok := reloadConfig("received " + sig.String()); ok {
+					swapConfig(newConfig)
+				}
+
+			case containsSignal(scanSignals, sig):
+				slog.Info("Scanning now", "signal", sig.String())
+				startScan()
+			}
+
+		case <-status.scans:
+			slog.Info("Scanning now", "reason", "requested through the API")
+			startScan()
+		}
+	}
+}
+
+// configStamp identifies a version of the config files on disk
+type configStamp struct {
+	modTime time.Time // Latest modification of any config file
+	size    int64     // Total size of the config files
+	files   int
+}
+
+// statConfig returns the current stamp of the config file at path and its config directory
+func statConfig(path string) configStamp {
+	var stamp configStamp
+	add := func(file string) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return
+		}
+		if info.ModTime().After(stamp.modTime) {
+			stamp.modTime = info.ModTime()
+		}
+		stamp.size += info.Size()
+		stamp.files++
+	}
+	if path != "" {
+		add(path)
+	}
+	files, _ := configDirFiles(configDirPath(path))
+	for _, file := range files {
+		add(file)
+	}
+	return stamp
+}
+
+// reloadConfig reads and validates the config file again. An unreadable or
+// invalid config is rejected and the caller keeps using the current one.
+func reloadConfig(reason string) (Config, bool) {
+	config, err := readConfig(*configFilePath)
+	if err != nil {
+		slog.Error("Not reloading the config, keeping the current one", "path", *configFilePath, "reason", reason, logging.Err(err))
+		return Config{}, false
+	}
+	slog.Info("Reloaded the config", "path", *configFilePath, "reason", reason)
+	return config, true
+}
+
+// applyConfig switches from the old to the new config between scans, moving
+// the processed files list and state database along if the destination changed
+func applyConfig(old, new Config) Config {
+	if new.DefaultDestinationDir != old.DefaultDestinationDir {
+		flushState()
+		openState(new.DefaultDestinationDir)
+		// The journal of temporary files moves along with the state
+		openTempDirs(new.DefaultDestinationDir, destinationDirs(new))
+	}
+	if new.LockFilePath != old.LockFilePath {
+		slog.Warn("lockFilePath changed, the new lock file is only used after a restart")
+	}
+	if new.MetricsAddress != old.MetricsAddress {
+		slog.Warn("metricsAddress changed, the new address is only used after a restart")
+	}
+	if new.APIAddress != old.APIAddress {
+		slog.Warn("apiAddress changed, the new address is only used after a restart")
+	}
+	return new
+}
+
+// shutdown waits for a running scan to finish its in-flight files. If they
+// don't finish within -shutdown-timeout their temporary files are removed so
+// nothing half-written is left behind.
+func shutdown(scanning bool, scanDone <-chan struct{}) int {
+	code := 0
+	if scanning {
+		select {
+		case <-scanDone:
+		case <-time.After(*shutdownTimeout):
+			slog.Warn("In-flight files did not finish in time, rolling them back", "timeout", *shutdownTimeout)
+			removeInFlightTemps()
+			code = 1
+		}
+	}
+	flushState()
+	return code
+}
+
+// containsSignal reports whether sig is one of signals
+func containsSignal(signals []os.Signal, sig os.Signal) bool {
+	for _, s := range signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}